@@ -3,6 +3,7 @@ module github.com/ekristen/satokens
 go 1.19
 
 require (
+	github.com/fsnotify/fsnotify v1.7.0
 	github.com/gorilla/mux v1.8.0
 	github.com/jacobsa/fuse v0.0.0-20230225155227-86031ac261e8
 	github.com/rancher/wrangler v1.1.1
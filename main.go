@@ -13,8 +13,10 @@ import (
 
 	_ "github.com/ekristen/satokens/pkg/commands/deploy"
 	_ "github.com/ekristen/satokens/pkg/commands/destroy"
+	_ "github.com/ekristen/satokens/pkg/commands/exec"
 	_ "github.com/ekristen/satokens/pkg/commands/mount"
 	_ "github.com/ekristen/satokens/pkg/commands/server"
+	_ "github.com/ekristen/satokens/pkg/commands/sync"
 )
 
 func main() {
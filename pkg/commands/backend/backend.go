@@ -0,0 +1,353 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"github.com/ekristen/satokens/pkg/common"
+	"github.com/ekristen/satokens/pkg/portforward"
+	"github.com/ekristen/satokens/pkg/tokensource"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// ServerPort is the port the satokens server listens on inside the pod.
+	ServerPort = 44044
+
+	// handshakeTimeout bounds how long connecting waits for the pod to report its version, and every check of it.
+	handshakeTimeout = 30 * time.Second
+
+	// handshakeRetry is how long to wait before checking the pod again when it couldn't be.
+	handshakeRetry = 10 * time.Second
+)
+
+// Flags are shared by every command that consumes tokens.
+func Flags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    "pod-name",
+			Usage:   "pod-name",
+			EnvVars: []string{"POD_NAME"},
+			Value:   "satokens",
+		},
+		&cli.StringFlag{
+			Name:    "namespace",
+			Usage:   "namespace to use for the pod",
+			EnvVars: []string{"NAMESPACE"},
+			Value:   "default",
+		},
+		&cli.StringFlag{
+			Name:    "backend",
+			Usage:   "where tokens come from, server (the deployed satokens pod) or mint (the token request api)",
+			EnvVars: []string{"BACKEND"},
+			Value:   "server",
+		},
+		&cli.BoolFlag{
+			Name:    "listen",
+			Usage:   "expose the port-forward on a local port instead of dialing the pod in-process (server backend only)",
+			EnvVars: []string{"LISTEN"},
+		},
+		&cli.StringFlag{
+			Name:    "local-address",
+			Usage:   "local address the port-forward listens on (with --listen)",
+			EnvVars: []string{"LOCAL_ADDRESS"},
+			Value:   "127.0.0.1",
+		},
+		&cli.IntFlag{
+			Name:    "local-port",
+			Usage:   "local port the port-forward listens on, 0 lets the os pick a free port (with --listen)",
+			EnvVars: []string{"LOCAL_PORT"},
+			Value:   0,
+		},
+		&cli.StringFlag{
+			Name:    "minter",
+			Usage:   "who mints tokens with the token request api for the server backend, client (your own credentials) or server (the pod, requires deploy --mint)",
+			EnvVars: []string{"MINTER"},
+			Value:   "client",
+		},
+		&cli.StringFlag{
+			Name:    "service-account-name",
+			Usage:   "the name of the service account to mint tokens for (mint backend, or server backend with --minter server)",
+			EnvVars: []string{"SERVICE_ACCOUNT"},
+			Value:   "default",
+		},
+		&cli.Int64Flag{
+			Name:    "expiration",
+			Usage:   "token expiration in seconds (mint backend, or server backend with --minter server)",
+			Value:   7200,
+			EnvVars: []string{"EXPIRATION"},
+			Aliases: []string{"exp"},
+		},
+		&cli.StringFlag{
+			Name:    "audience",
+			Usage:   "token audience (mint backend, or server backend with --minter server)",
+			Value:   "sts.amazonaws.com",
+			EnvVars: []string{"AUDIENCE"},
+			Aliases: []string{"aud"},
+		},
+		&cli.Float64Flag{
+			Name:    "refresh-fraction",
+			Usage:   "fraction of a token's lifetime after which it is refreshed in the background",
+			EnvVars: []string{"REFRESH_FRACTION"},
+			Value:   tokensource.DefaultRefreshFraction,
+		},
+		&cli.BoolFlag{
+			Name:    "serve-stale",
+			Usage:   "keep serving the last known good token until it expires when refreshing fails",
+			EnvVars: []string{"SERVE_STALE"},
+			Value:   true,
+		},
+	}
+}
+
+// CacheConfig returns the cache settings selected by the flags.
+func CacheConfig(c *cli.Context) tokensource.CacheConfig {
+	return tokensource.CacheConfig{
+		RefreshFraction: c.Float64("refresh-fraction"),
+		ServeStale:      c.Bool("serve-stale"),
+	}
+}
+
+// New returns the token source selected by the --backend flag. For the server backend the port-forward is
+// supervised until ctx is done and its status is returned alongside, it is nil for the other backends.
+func New(ctx context.Context, c *cli.Context, cfg *rest.Config, kube kubernetes.Interface) (tokensource.TokenSource, *portforward.Status, error) {
+	switch c.String("minter") {
+	case "client", "server":
+	default:
+		return nil, nil, fmt.Errorf("unknown minter: %s", c.String("minter"))
+	}
+
+	switch c.String("backend") {
+	case "server":
+		return serverSource(ctx, c, cfg, kube)
+	case "mint":
+		logrus.Info("minting tokens with the token request api")
+
+		return &tokensource.TokenRequestSource{
+			Client:             kube.CoreV1(),
+			ConfigMaps:         kube.CoreV1(),
+			Namespace:          c.String("namespace"),
+			ServiceAccountName: c.String("service-account-name"),
+			Audiences:          []string{c.String("audience")},
+			ExpirationSeconds:  c.Int64("expiration"),
+		}, nil, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown backend: %s", c.String("backend"))
+	}
+}
+
+// Describe returns where the backend gets tokens from, e.g. server:default/satokens for the pod of the server
+// backend or mint:default/app for the service account tokens are minted for.
+func Describe(c *cli.Context) string {
+	if c.String("backend") == "mint" {
+		return fmt.Sprintf("mint:%s/%s", c.String("namespace"), c.String("service-account-name"))
+	}
+
+	return fmt.Sprintf("%s:%s/%s", c.String("backend"), c.String("namespace"), c.String("pod-name"))
+}
+
+// Minter returns the source tokens for arbitrary audiences and expirations are minted from. The mint backend
+// mints tokens itself, for the server backend tokens are minted by the pod with --minter server, otherwise
+// client side with the token request api for the service account of the pod, which requires that your own
+// credentials are allowed to.
+func Minter(ctx context.Context, c *cli.Context, kube kubernetes.Interface, source tokensource.TokenSource) tokensource.MintingSource {
+	if minter, ok := source.(tokensource.MintingSource); ok && (c.String("backend") != "server" || c.String("minter") == "server") {
+		return minter
+	}
+
+	name, err := ServiceAccountName(ctx, c, kube)
+	if err != nil {
+		logrus.WithError(err).Warn("unable to determine service account, tokens can't be minted")
+		return nil
+	}
+
+	return &tokensource.TokenRequestSource{
+		Client:             kube.CoreV1(),
+		Namespace:          c.String("namespace"),
+		ServiceAccountName: name,
+		ExpirationSeconds:  c.Int64("expiration"),
+	}
+}
+
+// ServiceAccountName returns the name of the service account tokens are issued for, for the server backend
+// that is the service account of the pod unless the pod mints them for another one.
+func ServiceAccountName(ctx context.Context, c *cli.Context, kube kubernetes.Interface) (string, error) {
+	if c.String("backend") == "mint" || serverMints(c) {
+		return c.String("service-account-name"), nil
+	}
+
+	pod, err := kube.CoreV1().Pods(c.String("namespace")).Get(ctx, c.String("pod-name"), metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	return pod.Spec.ServiceAccountName, nil
+}
+
+// serverSource connects to the satokens pod. By default the token is fetched over a stream dialed in-process,
+// with --listen the port-forward is exposed on a local port instead.
+func serverSource(ctx context.Context, c *cli.Context, cfg *rest.Config, kube kubernetes.Interface) (tokensource.TokenSource, *portforward.Status, error) {
+	status := &portforward.Status{}
+
+	opts := portforward.PortForwardOptions{
+		Config:     cfg,
+		RESTClient: kube.CoreV1().RESTClient(),
+		Namespace:  c.String("namespace"),
+		PodName:    c.String("pod-name"),
+		PodClient:  kube.CoreV1(),
+		Status:     status,
+	}
+
+	var source *tokensource.HTTPSource
+
+	if c.Bool("listen") {
+		localAddress := c.String("local-address")
+		localPort := c.Int("local-port")
+		if localPort == 0 {
+			var err error
+			localPort, err = portforward.FreePort(localAddress)
+			if err != nil {
+				return nil, nil, fmt.Errorf("unable to allocate a local port: %w", err)
+			}
+		}
+
+		local := net.JoinHostPort(localAddress, strconv.Itoa(localPort))
+
+		opts.Address = []string{localAddress}
+		opts.Ports = []string{fmt.Sprintf("%d:%d", localPort, ServerPort)}
+		opts.PortForwarder = portforward.DefaultPortForwarder{}
+
+		logrus.WithField("local", local).Info("connecting to satokens pod in cluster")
+
+		source = tokensource.NewHTTPSource(fmt.Sprintf("http://%s", local))
+	} else {
+		dialer := &portforward.Dialer{}
+
+		opts.PortForwarder = dialer
+
+		logrus.Info("connecting to satokens pod in cluster")
+
+		source = tokensource.NewHTTPSource(fmt.Sprintf("http://%s:%d", c.String("pod-name"), ServerPort))
+		source.Client.Transport = &http.Transport{
+			DialContext: dialer.DialContext,
+		}
+	}
+
+	source.Ready = status.Ready
+
+	go func() {
+		if err := opts.Supervise(ctx); err != nil {
+			logrus.WithError(err).Error("unable to run port forward")
+		}
+	}()
+
+	checked := make(chan error, 1)
+	go handshakes(ctx, c, source, status, checked)
+
+	select {
+	case err := <-checked:
+		if err != nil {
+			return nil, nil, err
+		}
+	case <-time.After(handshakeTimeout):
+		logrus.Warn("unable to check the version of the satokens pod yet, it is once it can be reached and tokens aren't minted in the pod until then")
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+
+	if serverMints(c) {
+		logrus.WithField("service-account", c.String("service-account-name")).Info("minting tokens in the satokens pod")
+
+		source = source.MintFor(c.String("service-account-name"), c.String("audience"), c.Int64("expiration"))
+	}
+
+	return source, status, nil
+}
+
+// handshakes runs the handshake every time the port-forward connects until ctx is done, as the pod may have been
+// redeployed with another version in the meantime. The result of the first one is sent to checked, the later ones
+// are logged.
+func handshakes(ctx context.Context, c *cli.Context, source *tokensource.HTTPSource, status *portforward.Status, checked chan<- error) {
+	var connected time.Time
+
+	for {
+		changed := status.Changed()
+
+		var retry <-chan time.Time
+		if state, _, since := status.State(); state == portforward.StateConnected && !since.Equal(connected) {
+			ok, err := handshake(ctx, c, source)
+			switch {
+			case !ok:
+				retry = time.After(handshakeRetry)
+			case checked != nil:
+				checked <- err
+				checked = nil
+			case err != nil:
+				logrus.WithError(err).Error("the satokens pod can't serve what was asked for")
+			}
+
+			if ok {
+				connected = since
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		case <-retry:
+		}
+	}
+}
+
+// handshake checks that the satokens pod speaks a protocol this client understands and has the capabilities the
+// flags require, warning about version mismatches and failing when it can't serve what was asked for. What was
+// learned is recorded on the source either way, so that it stops minting when the pod can't. It returns false
+// when the pod couldn't be reached to check.
+func handshake(ctx context.Context, c *cli.Context, source *tokensource.HTTPSource) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+	defer cancel()
+
+	version, err := source.Version(ctx)
+	if err != nil {
+		logrus.WithError(err).Warn("unable to check the version of the satokens pod")
+		return false, nil
+	}
+
+	source.Server.Set(version)
+
+	upgrade := fmt.Sprintf("run satokens deploy to upgrade it to %s", common.AppVersion.Summary)
+
+	switch {
+	case version.Protocol == 0:
+		logrus.Warnf("the satokens pod predates versioning, %s", upgrade)
+	case version.Protocol < tokensource.ProtocolVersion:
+		logrus.Warnf("the satokens pod (%s) is older than this client, %s", version.Summary, upgrade)
+	case version.Protocol > tokensource.ProtocolVersion:
+		logrus.Warnf("the satokens pod (%s) is newer than this client (%s), consider upgrading satokens", version.Summary, common.AppVersion.Summary)
+	case version.Version != common.AppVersion.Version:
+		logrus.Infof("the satokens pod runs %s, this client %s", version.Summary, common.AppVersion.Summary)
+	}
+
+	if c.String("minter") == "server" && !version.Supports(tokensource.CapabilityMint) {
+		if version.Protocol < tokensource.ProtocolVersion {
+			return true, fmt.Errorf("the satokens pod can't mint tokens, %s and enable minting with --mint", upgrade)
+		}
+		return true, fmt.Errorf("the satokens pod doesn't mint tokens, run satokens deploy --mint to enable it")
+	}
+
+	return true, nil
+}
+
+// serverMints is true when the pod mints the default token for the service account given with
+// --service-account-name, instead of serving its own projected token.
+func serverMints(c *cli.Context) bool {
+	return c.String("backend") == "server" && c.String("minter") == "server" && c.IsSet("service-account-name")
+}
@@ -4,21 +4,27 @@ import (
 	"fmt"
 	"github.com/ekristen/satokens/pkg/commands/global"
 	"github.com/ekristen/satokens/pkg/common"
+	"github.com/ekristen/satokens/pkg/tokenfs"
+	"github.com/ekristen/satokens/pkg/tokensource"
 	"github.com/rancher/wrangler/pkg/apply"
 	"github.com/rancher/wrangler/pkg/kubeconfig"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	_ "github.com/rancher/wrangler/pkg/generated/controllers/apps"
 	_ "github.com/rancher/wrangler/pkg/generated/controllers/core"
+	_ "github.com/rancher/wrangler/pkg/generated/controllers/rbac"
 )
 
 func Execute(c *cli.Context) error {
@@ -66,6 +72,77 @@ func Execute(c *cli.Context) error {
 		}
 	*/
 
+	specs, err := parseTokenSpecs(*c.Generic("token").(*specList), c.Int64("expiration"), filePath)
+	if err != nil {
+		return err
+	}
+
+	args := []string{
+		"server",
+		fmt.Sprintf("--path=%s", c.Path("path")),
+		fmt.Sprintf("--ca-path=%s", filepath.Join(filepath.Dir(c.Path("path")), "ca.crt")),
+		fmt.Sprintf("--namespace-path=%s", filepath.Join(filepath.Dir(c.Path("path")), "namespace")),
+	}
+
+	if c.Bool("mint") {
+		args = append(args, "--mint")
+
+		// the first is its own, which the server always allows
+		for _, name := range mintServiceAccounts(c)[1:] {
+			args = append(args, fmt.Sprintf("--mint-service-account=%s", name))
+		}
+	}
+
+	projections := []corev1.VolumeProjection{
+		{
+			ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
+				Path:              filePath,
+				ExpirationSeconds: &[]int64{c.Int64("expiration")}[0],
+				Audience:          c.String("audience"),
+			},
+		},
+	}
+
+	for _, spec := range specs {
+		args = append(args, fmt.Sprintf("--token=%s=%s", spec.Name, filepath.Join(filepath.Dir(c.Path("path")), spec.Name)))
+
+		projections = append(projections, corev1.VolumeProjection{
+			ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
+				Path:              spec.Name,
+				ExpirationSeconds: &[]int64{spec.Expiration}[0],
+				Audience:          spec.Audience,
+			},
+		})
+	}
+
+	projections = append(projections,
+		corev1.VolumeProjection{
+			ConfigMap: &corev1.ConfigMapProjection{
+				LocalObjectReference: corev1.LocalObjectReference{
+					Name: tokensource.RootCAConfigMap,
+				},
+				Items: []corev1.KeyToPath{
+					{
+						Key:  "ca.crt",
+						Path: "ca.crt",
+					},
+				},
+			},
+		},
+		corev1.VolumeProjection{
+			DownwardAPI: &corev1.DownwardAPIProjection{
+				Items: []corev1.DownwardAPIVolumeFile{
+					{
+						Path: "namespace",
+						FieldRef: &corev1.ObjectFieldSelector{
+							APIVersion: "v1",
+							FieldPath:  "metadata.namespace",
+						},
+					},
+				},
+			},
+		})
+
 	var objects []runtime.Object
 
 	if c.Bool("create-service-account") {
@@ -79,6 +156,10 @@ func Execute(c *cli.Context) error {
 		objects = append(objects, sa)
 	}
 
+	if c.Bool("mint") {
+		objects = append(objects, mintRBAC(c)...)
+	}
+
 	pod := &corev1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      c.String("pod-name"),
@@ -93,10 +174,7 @@ func Execute(c *cli.Context) error {
 					Command: []string{
 						"satokens",
 					},
-					Args: []string{
-						"server",
-						fmt.Sprintf("--path=%s", c.Path("path")),
-					},
+					Args: args,
 					Ports: []corev1.ContainerPort{
 						{
 							Name:          "server",
@@ -116,15 +194,7 @@ func Execute(c *cli.Context) error {
 					Name: "sa-token",
 					VolumeSource: corev1.VolumeSource{
 						Projected: &corev1.ProjectedVolumeSource{
-							Sources: []corev1.VolumeProjection{
-								{
-									ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
-										Path:              filePath,
-										ExpirationSeconds: &[]int64{c.Int64("expiration")}[0],
-										Audience:          c.String("audience"),
-									},
-								},
-							},
+							Sources: projections,
 						},
 					},
 				},
@@ -163,6 +233,145 @@ func Execute(c *cli.Context) error {
 	return nil
 }
 
+// mintServiceAccounts returns the service accounts the pod may mint tokens for, its own and those given with
+// --mint-service-account.
+func mintServiceAccounts(c *cli.Context) []string {
+	names := []string{c.String("service-account-name")}
+	for _, name := range c.StringSlice("mint-service-account") {
+		// MINT_SERVICE_ACCOUNTS may be empty or list names with spaces after the commas
+		name = strings.TrimSpace(name)
+		if name != "" && name != c.String("service-account-name") {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// mintRBAC returns the role and binding that allow the service account of the pod to create tokens for the
+// service accounts returned by mintServiceAccounts.
+func mintRBAC(c *cli.Context) []runtime.Object {
+	name := fmt.Sprintf("%s-mint", c.String("pod-name"))
+
+	role := &rbacv1.Role{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: c.String("namespace"),
+		},
+		Rules: []rbacv1.PolicyRule{
+			{
+				APIGroups:     []string{""},
+				Resources:     []string{"serviceaccounts/token"},
+				Verbs:         []string{"create"},
+				ResourceNames: mintServiceAccounts(c),
+			},
+		},
+	}
+
+	binding := &rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: c.String("namespace"),
+		},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: rbacv1.GroupName,
+			Kind:     "Role",
+			Name:     name,
+		},
+		Subjects: []rbacv1.Subject{
+			{
+				Kind:      rbacv1.ServiceAccountKind,
+				Name:      c.String("service-account-name"),
+				Namespace: c.String("namespace"),
+			},
+		},
+	}
+
+	return []runtime.Object{role, binding}
+}
+
+// tokenSpec is an additional token projected into the pod next to the default one.
+type tokenSpec struct {
+	Name       string
+	Audience   string
+	Expiration int64
+}
+
+// specList collects the values of a repeated flag, unlike cli.StringSliceFlag it doesn't split them on commas.
+type specList []string
+
+func (l *specList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func (l *specList) String() string {
+	return strings.Join(*l, " ")
+}
+
+// parseTokenSpecs parses specs of the form audience=<audience>[,expiration=<seconds>][,name=<file>]. The name
+// defaults to the audience with anything that isn't safe in a file name replaced.
+func parseTokenSpecs(specs []string, defaultExpiration int64, reserved ...string) ([]tokenSpec, error) {
+	var tokens []tokenSpec
+
+	// names of the other files the mount serves
+	names := map[string]bool{}
+	for _, name := range append(tokenfs.ReservedNames(), reserved...) {
+		names[name] = true
+	}
+
+	for _, spec := range specs {
+		token := tokenSpec{
+			Expiration: defaultExpiration,
+		}
+
+		for _, field := range strings.Split(spec, ",") {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok {
+				return nil, fmt.Errorf("invalid token %q, expected key=value pairs", spec)
+			}
+
+			switch strings.TrimSpace(key) {
+			case "audience", "aud":
+				token.Audience = value
+			case "expiration", "exp":
+				exp, err := strconv.ParseInt(value, 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid expiration in token %q: %w", spec, err)
+				}
+				token.Expiration = exp
+			case "name":
+				token.Name = value
+			default:
+				return nil, fmt.Errorf("invalid token %q, unknown key %q", spec, key)
+			}
+		}
+
+		if token.Audience == "" {
+			return nil, fmt.Errorf("invalid token %q, audience is required", spec)
+		}
+
+		if token.Name == "" {
+			token.Name = unsafeFileChars.ReplaceAllString(token.Audience, "_")
+		}
+
+		if strings.Contains(token.Name, "/") || strings.HasPrefix(token.Name, ".") {
+			return nil, fmt.Errorf("invalid token name %q", token.Name)
+		}
+
+		if names[token.Name] {
+			return nil, fmt.Errorf("duplicate token name %q", token.Name)
+		}
+		names[token.Name] = true
+
+		tokens = append(tokens, token)
+	}
+
+	return tokens, nil
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
 func init() {
 	flags := []cli.Flag{
 		&cli.StringFlag{
@@ -196,6 +405,12 @@ func init() {
 			EnvVars: []string{"AUDIENCE"},
 			Aliases: []string{"aud"},
 		},
+		&cli.GenericFlag{
+			Name:    "token",
+			Usage:   "additional token to project, in the form audience=<aud>[,expiration=<seconds>][,name=<file>] (repeatable)",
+			EnvVars: []string{"TOKENS"},
+			Value:   &specList{},
+		},
 		&cli.StringFlag{
 			Name:    "image",
 			Usage:   "image",
@@ -214,6 +429,16 @@ func init() {
 			EnvVars: []string{"CREATE_SERVICE_ACCOUNT", "CREATE_SA"},
 			Aliases: []string{"create", "c"},
 		},
+		&cli.BoolFlag{
+			Name:    "mint",
+			Usage:   "let the pod mint tokens with the token request api, creates a role allowing its service account to",
+			EnvVars: []string{"MINT"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "mint-service-account",
+			Usage:   "other service account the pod may mint tokens for, besides its own (repeatable, with --mint)",
+			EnvVars: []string{"MINT_SERVICE_ACCOUNTS"},
+		},
 	}
 
 	cliCmd := &cli.Command{
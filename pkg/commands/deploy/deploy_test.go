@@ -0,0 +1,182 @@
+package deploy
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/urfave/cli/v2"
+)
+
+func TestParseTokenSpecs(t *testing.T) {
+	tests := []struct {
+		name     string
+		specs    []string
+		reserved []string
+		want     []tokenSpec
+		wantErr  bool
+	}{
+		{name: "none"},
+		{
+			name:  "audience",
+			specs: []string{"audience=vault"},
+			want:  []tokenSpec{{Name: "vault", Audience: "vault", Expiration: 3600}},
+		},
+		{
+			name:  "short keys",
+			specs: []string{"aud=vault,exp=600"},
+			want:  []tokenSpec{{Name: "vault", Audience: "vault", Expiration: 600}},
+		},
+		{
+			name:  "name",
+			specs: []string{"audience=sts.amazonaws.com,name=aws,expiration=86400"},
+			want:  []tokenSpec{{Name: "aws", Audience: "sts.amazonaws.com", Expiration: 86400}},
+		},
+		{
+			name:  "name from unsafe audience",
+			specs: []string{"audience=https://vault.example.com:8200/v1"},
+			want:  []tokenSpec{{Name: "https_vault.example.com_8200_v1", Audience: "https://vault.example.com:8200/v1", Expiration: 3600}},
+		},
+		{
+			name:  "several",
+			specs: []string{"audience=a", "audience=b,name=c"},
+			want: []tokenSpec{
+				{Name: "a", Audience: "a", Expiration: 3600},
+				{Name: "c", Audience: "b", Expiration: 3600},
+			},
+		},
+		{name: "missing audience", specs: []string{"name=vault"}, wantErr: true},
+		{name: "not key=value", specs: []string{"vault"}, wantErr: true},
+		{name: "unknown key", specs: []string{"audience=vault,ttl=60"}, wantErr: true},
+		{name: "invalid expiration", specs: []string{"audience=vault,expiration=1h"}, wantErr: true},
+		{name: "name with a slash", specs: []string{"audience=vault,name=a/b"}, wantErr: true},
+		{name: "hidden name", specs: []string{"audience=vault,name=.data"}, wantErr: true},
+		{name: "duplicate name", specs: []string{"audience=vault", "audience=other,name=vault"}, wantErr: true},
+		{name: "name of another file", specs: []string{"audience=namespace"}, wantErr: true},
+		{name: "name of the default token", specs: []string{"audience=vault,name=token"}, wantErr: true},
+		{name: "name of the mint tree", specs: []string{"audience=aud"}, wantErr: true},
+		{name: "reserved name", specs: []string{"audience=vault"}, reserved: []string{"vault"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTokenSpecs(tt.specs, 3600, tt.reserved...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTokenSpecs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseTokenSpecs() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSpecListFlag(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  string
+		want []string
+	}{
+		{name: "none", want: []string{}},
+		{
+			name: "commas aren't separators",
+			args: []string{"--token", "audience=a,name=b"},
+			want: []string{"audience=a,name=b"},
+		},
+		{
+			name: "repeated",
+			args: []string{"--token", "audience=a,name=b", "--token", "audience=c"},
+			want: []string{"audience=a,name=b", "audience=c"},
+		},
+		{
+			name: "env",
+			env:  "audience=a,expiration=600",
+			want: []string{"audience=a,expiration=600"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SATOKENS_TEST_TOKENS", tt.env)
+
+			var got []string
+			app := &cli.App{
+				Flags: []cli.Flag{
+					&cli.GenericFlag{
+						Name:    "token",
+						EnvVars: []string{"SATOKENS_TEST_TOKENS"},
+						Value:   &specList{},
+					},
+				},
+				Action: func(c *cli.Context) error {
+					got = *c.Generic("token").(*specList)
+					return nil
+				},
+			}
+
+			if err := app.Run(append([]string{"deploy"}, tt.args...)); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("--token = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMintServiceAccounts(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  string
+		want []string
+	}{
+		{name: "own only", want: []string{"app"}},
+		{
+			name: "repeated",
+			args: []string{"--mint-service-account", "worker", "--mint-service-account", "app", "--mint-service-account", "batch"},
+			want: []string{"app", "worker", "batch"},
+		},
+		{
+			name: "env",
+			env:  "worker,batch",
+			want: []string{"app", "worker", "batch"},
+		},
+		{
+			name: "env with spaces",
+			env:  "worker, batch",
+			want: []string{"app", "worker", "batch"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SATOKENS_TEST_MINT_SERVICE_ACCOUNTS", tt.env)
+
+			var got []string
+			app := &cli.App{
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "service-account-name",
+						Value: "app",
+					},
+					&cli.StringSliceFlag{
+						Name:    "mint-service-account",
+						EnvVars: []string{"SATOKENS_TEST_MINT_SERVICE_ACCOUNTS"},
+					},
+				},
+				Action: func(c *cli.Context) error {
+					got = mintServiceAccounts(c)
+					return nil
+				},
+			}
+
+			if err := app.Run(append([]string{"deploy"}, tt.args...)); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mintServiceAccounts() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/ekristen/satokens/pkg/common"
 	"github.com/rancher/wrangler/pkg/apply"
 	corev1client "github.com/rancher/wrangler/pkg/generated/controllers/core"
+	rbacv1client "github.com/rancher/wrangler/pkg/generated/controllers/rbac"
 	"github.com/rancher/wrangler/pkg/kubeconfig"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
@@ -36,8 +37,23 @@ func Execute(c *cli.Context) error {
 		return err
 	}
 
+	rbac, err := rbacv1client.NewFactoryFromConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	if err := rbac.Start(c.Context, 50); err != nil {
+		return err
+	}
+
+	if err := rbac.Sync(c.Context); err != nil {
+		return err
+	}
+
 	_ = core.Core().V1().Pod().Cache()
 	_ = core.Core().V1().ServiceAccount().Cache()
+	_ = rbac.Rbac().V1().Role().Cache()
+	_ = rbac.Rbac().V1().RoleBinding().Cache()
 
 	time.Sleep(10 * time.Second)
 
@@ -47,7 +63,7 @@ func Execute(c *cli.Context) error {
 		WithSetID("satokens").
 		WithDynamicLookup().
 		WithStrictCaching().
-		WithCacheTypes(core.Core().V1().ServiceAccount(), core.Core().V1().Pod()).
+		WithCacheTypes(core.Core().V1().ServiceAccount(), core.Core().V1().Pod(), rbac.Rbac().V1().Role(), rbac.Rbac().V1().RoleBinding()).
 		ApplyObjects(objects...); err != nil {
 		return err
 	}
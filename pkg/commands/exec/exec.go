@@ -0,0 +1,299 @@
+package exec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ekristen/satokens/pkg/commands/backend"
+	"github.com/ekristen/satokens/pkg/commands/global"
+	"github.com/ekristen/satokens/pkg/common"
+	"github.com/ekristen/satokens/pkg/tokenfile"
+	"github.com/ekristen/satokens/pkg/tokenfs"
+	"github.com/ekristen/satokens/pkg/tokensource"
+	"github.com/jacobsa/fuse"
+	"github.com/rancher/wrangler/pkg/kubeconfig"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"os"
+	osexec "os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Annotations used by the EKS pod identity webhook and Azure workload identity to wire up pods.
+const (
+	awsRoleARNAnnotation     = "eks.amazonaws.com/role-arn"
+	awsRegionalSTSAnnotation = "eks.amazonaws.com/sts-regional-endpoints"
+	azureClientIDAnnotation  = "azure.workload.identity/client-id"
+	azureTenantIDAnnotation  = "azure.workload.identity/tenant-id"
+)
+
+const (
+	azureAuthorityHost = "https://login.microsoftonline.com/"
+	defaultTokenName   = "token"
+)
+
+func Execute(c *cli.Context) error {
+	if c.Args().Len() == 0 {
+		return fmt.Errorf("a command to run is required, e.g. satokens exec -- aws sts get-caller-identity")
+	}
+
+	cfg, err := kubeconfig.GetNonInteractiveClientConfig(c.String("kubeconfig")).ClientConfig()
+	if err != nil {
+		return err
+	}
+
+	kube, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	// The first interrupt cancels c.Context, everything here has to outlive that until the child has exited.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	source, _, err := backend.New(ctx, c, cfg, kube)
+	if err != nil {
+		return err
+	}
+
+	dir, err := os.MkdirTemp("", "satokens-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	switch c.String("mode") {
+	case "mount":
+		server, err := tokenfs.NewTokenFS(source, tokenfs.Config{
+			RefreshFraction: c.Float64("refresh-fraction"),
+			ServeStale:      c.Bool("serve-stale"),
+		})
+		if err != nil {
+			return err
+		}
+
+		mfs, err := tokenfs.Mount(dir, server, &fuse.MountConfig{
+			FSName:   "satokens",
+			Subtype:  "satokens",
+			ReadOnly: true,
+		})
+		if err != nil {
+			return fmt.Errorf("unable to mount token filesystem: %w", err)
+		}
+
+		defer func() {
+			unmountCtx, unmountCancel := context.WithTimeout(context.Background(), 15*time.Second)
+			defer unmountCancel()
+
+			if err := tokenfs.Unmount(unmountCtx, dir); err != nil {
+				logrus.WithError(err).Error("unable to unmount path")
+				return
+			}
+
+			if err := mfs.Join(unmountCtx); err != nil {
+				logrus.WithError(err).Error("unable to wait for unmount")
+			}
+		}()
+	case "file":
+		for _, name := range uniqueNames(c.String("aws-token"), c.String("azure-token"), defaultTokenName) {
+			fileSource := source
+			if name != defaultTokenName {
+				named, ok := source.(tokensource.NamedSource)
+				if !ok {
+					return fmt.Errorf("the %s backend only provides the default token", c.String("backend"))
+				}
+				fileSource = named.Named(name)
+			}
+
+			cache := tokensource.NewCache(fileSource, backend.CacheConfig(c))
+			go cache.Run(ctx)
+			go cache.Watch(ctx)
+
+			writer := &tokenfile.Writer{
+				Path:  filepath.Join(dir, name),
+				Cache: cache,
+			}
+
+			if err := writer.Sync(c.Context); err != nil {
+				return fmt.Errorf("unable to write token %s: %w", name, err)
+			}
+
+			go writer.Run(ctx)
+		}
+	default:
+		return fmt.Errorf("unknown mode: %s", c.String("mode"))
+	}
+
+	env, err := identityEnv(c, kube, dir)
+	if err != nil {
+		return err
+	}
+
+	cmd := osexec.Command(c.Args().First(), c.Args().Tail()...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	// Resetting takes over from the shutdown handler set up by main, which exits on the second interrupt and would
+	// leave the mount and the temporary directory behind while the child is still running.
+	signal.Reset(syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
+	defer signal.Stop(signals)
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	go func() {
+		for sig := range signals {
+			// the child shares our process group, so it already got the ones sent from the terminal
+			if sig == syscall.SIGINT || sig == syscall.SIGQUIT {
+				continue
+			}
+
+			if err := cmd.Process.Signal(sig); err != nil && !errors.Is(err, os.ErrProcessDone) {
+				logrus.WithError(err).Warnf("unable to forward %s to child", sig)
+			}
+		}
+	}()
+
+	err = cmd.Wait()
+
+	var exitErr *osexec.ExitError
+	if errors.As(err, &exitErr) {
+		return cli.Exit("", exitErr.ExitCode())
+	}
+
+	return err
+}
+
+// identityEnv returns the environment variables the AWS and Azure SDKs look for to federate with the token,
+// taken from the flags or, failing that, from the annotations on the service account.
+func identityEnv(c *cli.Context, kube kubernetes.Interface, dir string) ([]string, error) {
+	annotations := map[string]string{}
+
+	if c.Bool("use-annotations") {
+		name, err := backend.ServiceAccountName(c.Context, c, kube)
+		if err != nil {
+			return nil, fmt.Errorf("unable to determine service account: %w", err)
+		}
+
+		sa, err := kube.CoreV1().ServiceAccounts(c.String("namespace")).Get(c.Context, name, metav1.GetOptions{})
+		if err != nil {
+			logrus.WithError(err).Warnf("unable to get service account %s, ignoring its annotations", name)
+		} else if sa.Annotations != nil {
+			annotations = sa.Annotations
+		}
+	}
+
+	env := []string{
+		fmt.Sprintf("SATOKENS_TOKEN_DIR=%s", dir),
+	}
+
+	if roleARN := firstNonEmpty(c.String("aws-role-arn"), annotations[awsRoleARNAnnotation]); roleARN != "" {
+		env = append(env,
+			fmt.Sprintf("AWS_ROLE_ARN=%s", roleARN),
+			fmt.Sprintf("AWS_WEB_IDENTITY_TOKEN_FILE=%s", filepath.Join(dir, c.String("aws-token"))),
+		)
+
+		if annotations[awsRegionalSTSAnnotation] == "true" {
+			env = append(env, "AWS_STS_REGIONAL_ENDPOINTS=regional")
+		}
+	}
+
+	if clientID := firstNonEmpty(c.String("azure-client-id"), annotations[azureClientIDAnnotation]); clientID != "" {
+		env = append(env,
+			fmt.Sprintf("AZURE_CLIENT_ID=%s", clientID),
+			fmt.Sprintf("AZURE_FEDERATED_TOKEN_FILE=%s", filepath.Join(dir, c.String("azure-token"))),
+			fmt.Sprintf("AZURE_AUTHORITY_HOST=%s", azureAuthorityHost),
+		)
+
+		if tenantID := firstNonEmpty(c.String("azure-tenant-id"), annotations[azureTenantIDAnnotation]); tenantID != "" {
+			env = append(env, fmt.Sprintf("AZURE_TENANT_ID=%s", tenantID))
+		}
+	}
+
+	return env, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func uniqueNames(names ...string) []string {
+	var unique []string
+	seen := map[string]bool{}
+	for _, name := range names {
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		unique = append(unique, name)
+	}
+	return unique
+}
+
+func init() {
+	flags := []cli.Flag{
+		&cli.StringFlag{
+			Name:  "mode",
+			Usage: "how the token is provided to the command, mount (a fuse filesystem) or file (a regular temporary file)",
+			Value: "mount",
+		},
+		&cli.BoolFlag{
+			Name:  "use-annotations",
+			Usage: "configure identity environment variables from the annotations of the service account",
+			Value: true,
+		},
+		&cli.StringFlag{
+			Name:  "aws-role-arn",
+			Usage: "role to assume, sets AWS_ROLE_ARN and AWS_WEB_IDENTITY_TOKEN_FILE",
+		},
+		&cli.StringFlag{
+			Name:  "aws-token",
+			Usage: "name of the token file to use for AWS",
+			Value: defaultTokenName,
+		},
+		&cli.StringFlag{
+			Name:  "azure-client-id",
+			Usage: "client id of the managed identity or app registration, sets AZURE_CLIENT_ID and AZURE_FEDERATED_TOKEN_FILE",
+		},
+		&cli.StringFlag{
+			Name:  "azure-tenant-id",
+			Usage: "tenant id to authenticate against, sets AZURE_TENANT_ID",
+		},
+		&cli.StringFlag{
+			Name:  "azure-token",
+			Usage: "name of the token file to use for Azure",
+			Value: defaultTokenName,
+		},
+	}
+
+	cliCmd := &cli.Command{
+		Name:      "exec",
+		Usage:     "run a command with the token and workload identity environment variables available",
+		ArgsUsage: "-- command [args...]",
+		Description: `The exec command makes the token available for the lifetime of the command, either through a temporary
+mount or a temporary file, and sets the environment variables the AWS and Azure SDKs use for web identity federation.
+SIGTERM and SIGHUP are forwarded to the command, interrupts from the terminal reach it directly, and everything is
+cleaned up once it exits.`,
+		Action: Execute,
+		Flags:  append(append(flags, backend.Flags()...), global.Flags()...),
+		Before: global.Before,
+	}
+
+	common.RegisterCommand(cliCmd)
+}
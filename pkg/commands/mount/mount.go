@@ -3,17 +3,22 @@ package mount
 import (
 	"context"
 	"fmt"
-	"github.com/ekristen/satokens/pkg/commands/global"
-	"github.com/ekristen/satokens/pkg/common"
-	"github.com/ekristen/satokens/pkg/portforward"
-	"github.com/ekristen/satokens/pkg/tokenfs"
+	"os"
+	"strconv"
+	"time"
+
 	"github.com/jacobsa/fuse"
 	"github.com/rancher/wrangler/pkg/kubeconfig"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 	"k8s.io/client-go/kubernetes"
-	"strings"
-	"time"
+
+	"github.com/ekristen/satokens/pkg/commands/backend"
+	"github.com/ekristen/satokens/pkg/commands/global"
+	"github.com/ekristen/satokens/pkg/common"
+	"github.com/ekristen/satokens/pkg/portforward"
+	"github.com/ekristen/satokens/pkg/tokenfs"
+	"github.com/ekristen/satokens/pkg/tokensource"
 )
 
 func Before(c *cli.Context) error {
@@ -33,6 +38,16 @@ func Execute(c *cli.Context) error {
 	// TODO: run mkdir -p
 	// TODO: rmdir
 
+	fileMode, err := strconv.ParseUint(c.String("file-mode"), 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid file mode %q: %w", c.String("file-mode"), err)
+	}
+
+	dirMode, err := strconv.ParseUint(c.String("dir-mode"), 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid dir mode %q: %w", c.String("dir-mode"), err)
+	}
+
 	cfg, err := kubeconfig.GetNonInteractiveClientConfig(c.String("kubeconfig")).ClientConfig()
 	if err != nil {
 		return err
@@ -43,28 +58,76 @@ func Execute(c *cli.Context) error {
 		return err
 	}
 
-	go func() {
-		opts := portforward.PortForwardOptions{
-			Config:        cfg,
-			RESTClient:    kube.CoreV1().RESTClient(),
-			Namespace:     c.String("namespace"),
-			PodName:       c.String("pod-name"),
-			PodClient:     kube.CoreV1(),
-			Address:       []string{"0.0.0.0"},
-			Ports:         []string{"44044:44044"},
-			PortForwarder: portforward.DefaultPortForwarder{},
-			StopChannel:   make(chan struct{}, 1),
-			ReadyChannel:  make(chan struct{}),
+	fsCfg := tokenfs.Config{
+		RefreshFraction: c.Float64("refresh-fraction"),
+		ServeStale:      c.Bool("serve-stale"),
+		Layout:          c.String("layout"),
+		FileMode:        os.FileMode(fileMode),
+		DirMode:         os.FileMode(dirMode),
+		Source:          backend.Describe(c),
+		Access: tokenfs.AccessPolicy{
+			Executables: c.StringSlice("allow-exe"),
+			Ancestors:   c.StringSlice("allow-ancestor"),
+		},
+	}
+
+	for _, uid := range c.UintSlice("allow-uid") {
+		fsCfg.Access.UIDs = append(fsCfg.Access.UIDs, uint32(uid))
+	}
+	for _, pid := range c.UintSlice("allow-pid") {
+		fsCfg.Access.PIDs = append(fsCfg.Access.PIDs, uint32(pid))
+	}
+
+	var source tokensource.TokenSource
+
+	if fsCfg.Layout == tokenfs.LayoutBrowse {
+		// tokens are minted for whatever service account is browsed, there is no backend
+		fsCfg.Source = "browse"
+		fsCfg.Browser = &tokensource.ServiceAccountBrowser{
+			Client:            kube.CoreV1(),
+			DefaultNamespace:  c.String("namespace"),
+			Audiences:         []string{c.String("audience")},
+			ExpirationSeconds: c.Int64("expiration"),
+		}
+	} else {
+		var status *portforward.Status
+
+		source, status, err = backend.New(c.Context, c, cfg, kube)
+		if err != nil {
+			return err
 		}
 
-		logrus.Info("connecting to satokens pod in cluster")
+		if status != nil {
+			fsCfg.Connection = status
+		}
 
-		if err := opts.RunPortForward(); err != nil {
-			logrus.WithError(err).Error("unable to run port forward")
+		if c.Bool("mint") {
+			fsCfg.Minter = backend.Minter(c.Context, c, kube, source)
 		}
-	}()
+	}
+
+	if path := c.Path("audit-log"); path != "" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return fmt.Errorf("unable to open audit log: %w", err)
+		}
+		defer f.Close()
+
+		fsCfg.Audit = tokenfs.NewAuditLog(f)
+	}
 
-	server, err := tokenfs.NewTokenFS()
+	if fsCfg.Access.Enabled() {
+		logrus.Info("restricting token access to allowed processes")
+	}
+
+	if c.IsSet("uid") {
+		fsCfg.UID = &[]uint32{uint32(c.Uint("uid"))}[0]
+	}
+	if c.IsSet("gid") {
+		fsCfg.GID = &[]uint32{uint32(c.Uint("gid"))}[0]
+	}
+
+	server, err := tokenfs.NewTokenFS(source, fsCfg)
 	if err != nil {
 		return err
 	}
@@ -78,18 +141,29 @@ func Execute(c *cli.Context) error {
 		}()
 
 		logrus.Info("attempting to unmount")
-		if err := unmount(ctx, c.Path("mount-path")); err != nil {
+		if err := tokenfs.Unmount(ctx, c.Path("mount-path")); err != nil {
 			logrus.WithError(err).Error("unable to unmount path")
 		}
 	}()
 
+	// Not mounted read-only so that commands can be written to .control, the filesystem refuses writes to
+	// anything else with EROFS.
 	fuseCfg := &fuse.MountConfig{
-		ReadOnly: true,
+		FSName:  "satokens",
+		Subtype: "satokens",
+		Options: map[string]string{},
+
+		// let the kernel enforce the permissions of the inodes
+		DisableDefaultPermissions: !c.Bool("default-permissions"),
+	}
+
+	if c.Bool("allow-other") {
+		fuseCfg.Options["allow_other"] = ""
 	}
 
 	logrus.Info("starting token filesystem")
 
-	mfs, err := fuse.Mount(c.Path("mount-path"), server, fuseCfg)
+	mfs, err := tokenfs.Mount(c.Path("mount-path"), server, fuseCfg)
 	if err != nil {
 		logrus.Fatalf("Mount: %v", err)
 	}
@@ -103,43 +177,77 @@ func Execute(c *cli.Context) error {
 	return nil
 }
 
-func unmount(ctx context.Context, dir string) error {
-	delay := 10 * time.Millisecond
-	for {
-		err := fuse.Unmount(dir)
-		if err == nil {
-			return err
-		}
-
-		if strings.Contains(err.Error(), "resource busy") {
-			logrus.Warn("Resource busy error while unmounting; trying again")
-			time.Sleep(delay)
-			delay = time.Duration(1.3 * float64(delay))
-			continue
-		}
-
-		return fmt.Errorf("unmount: %v", err)
-	}
-}
-
 func init() {
 	flags := []cli.Flag{
+		&cli.PathFlag{
+			Name:     "mount-path",
+			EnvVars:  []string{"MOUNT_PATH"},
+			Required: true,
+		},
 		&cli.StringFlag{
-			Name:    "pod-name",
-			Usage:   "pod-name",
-			EnvVars: []string{"POD_NAME"},
-			Value:   "satokens",
+			Name:    "layout",
+			Usage:   "layout of the mount, flat, atomic (kubelet style ..data symlinks) or browse (<namespace>/<service account>/token)",
+			EnvVars: []string{"LAYOUT"},
+			Value:   tokenfs.LayoutFlat,
+		},
+		&cli.UintFlag{
+			Name:    "uid",
+			Usage:   "owner of the files, defaults to the current user",
+			EnvVars: []string{"MOUNT_UID"},
+		},
+		&cli.UintFlag{
+			Name:    "gid",
+			Usage:   "group of the files, defaults to the current group",
+			EnvVars: []string{"MOUNT_GID"},
 		},
 		&cli.StringFlag{
-			Name:    "namespace",
-			Usage:   "namespace to use for the pod",
-			EnvVars: []string{"NAMESPACE"},
-			Value:   "default",
+			Name:    "file-mode",
+			Usage:   "permissions of the token files in octal, ca.crt and namespace are additionally readable by everyone",
+			EnvVars: []string{"FILE_MODE"},
+			Value:   "0600",
+		},
+		&cli.StringFlag{
+			Name:    "dir-mode",
+			Usage:   "permissions of the directories in octal",
+			EnvVars: []string{"DIR_MODE"},
+			Value:   "0755",
+		},
+		&cli.BoolFlag{
+			Name:    "allow-other",
+			Usage:   "allow other users to access the mount (requires user_allow_other in /etc/fuse.conf when not root)",
+			EnvVars: []string{"ALLOW_OTHER"},
+		},
+		&cli.BoolFlag{
+			Name:    "default-permissions",
+			Usage:   "have the kernel enforce the file permissions, disable to only rely on the mount being private",
+			EnvVars: []string{"DEFAULT_PERMISSIONS"},
+			Value:   true,
+		},
+		&cli.UintSliceFlag{
+			Name:  "allow-uid",
+			Usage: "only allow processes of this user to read tokens (linux only, repeatable)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "allow-exe",
+			Usage: "only allow executables matching this glob of absolute paths, or this name found in PATH, to read tokens (linux only, repeatable)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "allow-ancestor",
+			Usage: "only allow processes started from an executable matching this glob of absolute paths, or this name found in PATH, like a shell, to read tokens (linux only, repeatable)",
+		},
+		&cli.BoolFlag{
+			Name:    "mint",
+			Usage:   "serve aud/<audience>/exp/<seconds>/token, minting tokens for any audience and expiration on lookup",
+			EnvVars: []string{"MINT"},
 		},
 		&cli.PathFlag{
-			Name:     "mount-path",
-			EnvVars:  []string{"MOUNT_PATH"},
-			Required: true,
+			Name:    "audit-log",
+			Usage:   "append a JSON line for every open and read of a token, and every token issued, to this file",
+			EnvVars: []string{"AUDIT_LOG"},
+		},
+		&cli.UintSliceFlag{
+			Name:  "allow-pid",
+			Usage: "only allow this process and its descendants to read tokens (linux only, repeatable)",
 		},
 	}
 
@@ -147,7 +255,7 @@ func init() {
 		Name:   "mount",
 		Usage:  "mount the token to a local path",
 		Action: Execute,
-		Flags:  append(flags, global.Flags()...),
+		Flags:  append(append(flags, backend.Flags()...), global.Flags()...),
 		Before: Before,
 	}
 
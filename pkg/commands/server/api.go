@@ -0,0 +1,304 @@
+package server
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"k8s.io/apimachinery/pkg/util/json"
+
+	"github.com/ekristen/satokens/pkg/common"
+	"github.com/ekristen/satokens/pkg/tokensource"
+)
+
+const (
+	contentTypeJSON = "application/json"
+	contentTypeText = "text/plain; charset=utf-8"
+)
+
+// api serves the tokens of the pod. Every route but / and /tokens/{name}, which predate it, is versioned.
+type api struct {
+	c      *cli.Context
+	tokens map[string]string // additional tokens by name
+	names  []string          // sorted names of the additional tokens
+	pod    string
+
+	mu        sync.Mutex
+	rotations map[string]*rotation // GUARDED_BY(mu), by path
+	rotated   chan struct{}        // GUARDED_BY(mu), closed when any token rotates
+}
+
+// rotation tracks the changes of a token file seen by the server.
+type rotation struct {
+	sum   [sha256.Size]byte
+	count int
+	last  time.Time
+}
+
+func newAPI(c *cli.Context, tokens map[string]string, names []string) *api {
+	pod, err := os.Hostname()
+	if err != nil {
+		logrus.WithError(err).Warn("unable to determine pod name")
+	}
+
+	return &api{
+		c:         c,
+		tokens:    tokens,
+		names:     names,
+		pod:       pod,
+		rotations: map[string]*rotation{},
+		rotated:   make(chan struct{}),
+	}
+}
+
+func (a *api) register(router *mux.Router) {
+	router.Path("/").HandlerFunc(a.token)
+	router.Path("/tokens/{name}").HandlerFunc(a.namedToken)
+
+	router.Path("/v1/token").HandlerFunc(a.token)
+	router.Path("/v1/tokens/{name}").HandlerFunc(a.namedToken)
+	router.Path("/v1/metadata").HandlerFunc(a.metadata)
+	router.Path("/v1/watch").HandlerFunc(a.stream)
+
+	router.Path("/healthz").HandlerFunc(a.healthz)
+	router.Path("/readyz").HandlerFunc(a.readyz)
+	router.Path("/version").HandlerFunc(a.version)
+
+	router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("no route for %s", r.URL.Path))
+	})
+}
+
+func (a *api) token(w http.ResponseWriter, r *http.Request) {
+	payload, err := a.read(a.c.Path("path"))
+	if err != nil {
+		logrus.WithError(err).Error("unable to read token")
+		writeError(w, http.StatusInternalServerError, "unable to read token")
+		return
+	}
+
+	payload.Tokens = a.names
+
+	writeToken(w, r, payload)
+}
+
+func (a *api) namedToken(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	path, ok := a.tokens[name]
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unknown token %q", name))
+		return
+	}
+
+	payload, err := a.read(path)
+	if err != nil {
+		logrus.WithError(err).Errorf("unable to read token %s", name)
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("unable to read token %q", name))
+		return
+	}
+
+	writeToken(w, r, payload)
+}
+
+func (a *api) metadata(w http.ResponseWriter, r *http.Request) {
+	metadata := &tokensource.Metadata{
+		Pod:    a.pod,
+		Tokens: []tokensource.TokenMetadata{a.tokenMetadata("", a.c.Path("path"))},
+	}
+
+	for _, name := range a.names {
+		metadata.Tokens = append(metadata.Tokens, a.tokenMetadata(name, a.tokens[name]))
+	}
+
+	if a.c.Path("namespace-path") != "" {
+		if namespace, err := os.ReadFile(a.c.Path("namespace-path")); err == nil {
+			metadata.Namespace = strings.TrimSpace(string(namespace))
+		}
+	}
+
+	writeJSON(w, http.StatusOK, metadata)
+}
+
+func (a *api) tokenMetadata(name, path string) tokensource.TokenMetadata {
+	metadata := tokensource.TokenMetadata{
+		Name: name,
+	}
+
+	payload, err := a.read(path)
+	if err != nil {
+		metadata.Error = err.Error()
+		return metadata
+	}
+
+	a.mu.Lock()
+	if rot := a.rotations[path]; rot != nil {
+		metadata.Rotations = rot.count
+		if !rot.last.IsZero() {
+			metadata.LastRotation = &[]time.Time{rot.last}[0]
+		}
+	}
+	a.mu.Unlock()
+
+	token := tokensource.NewToken(payload.Contents)
+	if token.Claims == nil {
+		metadata.Error = "unable to parse token claims"
+		return metadata
+	}
+
+	metadata.Audience = token.Claims.Audience
+	if namespace, sa, ok := token.Claims.ServiceAccount(); ok {
+		metadata.ServiceAccount = fmt.Sprintf("%s/%s", namespace, sa)
+	}
+	if iat := token.IssuedAt(); !iat.IsZero() {
+		metadata.IssuedAt = &iat
+	}
+	if exp := token.ExpiresAt(); !exp.IsZero() {
+		metadata.ExpiresAt = &exp
+	}
+
+	return metadata
+}
+
+// healthz reports that the server is up, regardless of the state of the tokens.
+func (a *api) healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyz reports whether the default token can be served, it isn't until kubelet has projected it.
+func (a *api) readyz(w http.ResponseWriter, r *http.Request) {
+	payload, err := a.read(a.c.Path("path"))
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, fmt.Sprintf("unable to read token: %s", err))
+		return
+	}
+
+	if tokensource.NewToken(payload.Contents).Expired(time.Now()) {
+		writeError(w, http.StatusServiceUnavailable, "token has expired")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// version advertises the version of the server along with the protocol and capabilities clients can rely on.
+func (a *api) version(w http.ResponseWriter, r *http.Request) {
+	capabilities := []string{tokensource.CapabilityMetadata, tokensource.CapabilityWatch}
+	if a.c.Bool("mint") {
+		capabilities = append(capabilities, tokensource.CapabilityMint)
+	}
+
+	writeJSON(w, http.StatusOK, &tokensource.Version{
+		Version:      common.AppVersion.Version,
+		Summary:      common.AppVersion.Summary,
+		Commit:       common.AppVersion.Commit,
+		Branch:       common.AppVersion.Branch,
+		Protocol:     tokensource.ProtocolVersion,
+		Capabilities: capabilities,
+	})
+}
+
+// read reads the token at path, counting it as a rotation, and waking up the streams, when its contents changed
+// since the last read.
+func (a *api) read(path string) (*tokensource.Payload, error) {
+	payload, err := readPayload(a.c, path)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(payload.Contents)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	rot, ok := a.rotations[path]
+	switch {
+	case !ok:
+		a.rotations[path] = &rotation{sum: sum}
+	case rot.sum != sum:
+		rot.sum = sum
+		rot.count++
+		rot.last = time.Now()
+
+		close(a.rotated)
+		a.rotated = make(chan struct{})
+	}
+
+	return payload, nil
+}
+
+// writeToken writes the payload as JSON, or only the raw token to clients that prefer text/plain.
+func writeToken(w http.ResponseWriter, r *http.Request, payload *tokensource.Payload) {
+	if negotiate(r) == contentTypeText {
+		w.Header().Set("Content-Type", contentTypeText)
+		if _, err := w.Write(payload.Contents); err != nil {
+			logrus.WithError(err).Debug("unable to write token")
+		}
+		return
+	}
+
+	writeJSON(w, http.StatusOK, payload)
+}
+
+func writeJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.WriteHeader(code)
+
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		logrus.WithError(err).Debug("unable to write response")
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, &tokensource.ErrorResponse{
+		Error: tokensource.APIError{
+			Code:    code,
+			Message: message,
+		},
+	})
+}
+
+// negotiate returns the content type the client prefers according to its Accept header, JSON unless it
+// prefers text/plain.
+func negotiate(r *http.Request) string {
+	best, bestQ := contentTypeJSON, 0.0
+
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+
+		var contentType string
+		switch mediaType {
+		case "application/json", "application/*", "*/*":
+			contentType = contentTypeJSON
+		case "text/plain", "text/*":
+			contentType = contentTypeText
+		default:
+			continue
+		}
+
+		if q > bestQ {
+			best, bestQ = contentType, q
+		}
+	}
+
+	return best
+}
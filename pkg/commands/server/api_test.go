@@ -0,0 +1,42 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name   string
+		accept string
+		want   string
+	}{
+		{name: "no accept header", want: contentTypeJSON},
+		{name: "json", accept: "application/json", want: contentTypeJSON},
+		{name: "text", accept: "text/plain", want: contentTypeText},
+		{name: "text with charset", accept: "text/plain; charset=utf-8", want: contentTypeText},
+		{name: "any", accept: "*/*", want: contentTypeJSON},
+		{name: "any text", accept: "text/*", want: contentTypeText},
+		{name: "first of equals wins", accept: "text/plain, application/json", want: contentTypeText},
+		{name: "higher quality", accept: "text/plain;q=0.5, application/json", want: contentTypeJSON},
+		{name: "higher quality text", accept: "application/json;q=0.5, text/plain;q=0.9", want: contentTypeText},
+		{name: "browser", accept: "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", want: contentTypeJSON},
+		{name: "unsupported only", accept: "text/html", want: contentTypeJSON},
+		{name: "rejected text", accept: "text/plain;q=0", want: contentTypeJSON},
+		{name: "invalid quality", accept: "text/plain;q=high", want: contentTypeJSON},
+		{name: "invalid media type", accept: "text/plain;;, text/*", want: contentTypeText},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/v1/token", nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+
+			if got := negotiate(r); got != tt.want {
+				t.Errorf("negotiate() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
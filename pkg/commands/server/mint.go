@@ -0,0 +1,145 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/kubernetes"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+
+	"github.com/ekristen/satokens/pkg/tokensource"
+)
+
+// minter mints tokens with the TokenRequest API using the credentials of the pod, for its own service account and
+// those given with --mint-service-account. The role created by deploy enforces the same list.
+type minter struct {
+	c       *cli.Context
+	client  corev1client.ServiceAccountsGetter
+	allowed map[string]bool
+}
+
+func newMinter(c *cli.Context) (*minter, error) {
+	cfg, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("minting requires running in a pod: %w", err)
+	}
+
+	kube, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	allowed := map[string]bool{}
+	for _, name := range c.StringSlice("mint-service-account") {
+		if name = strings.TrimSpace(name); name != "" {
+			allowed[name] = true
+		}
+	}
+
+	return &minter{
+		c:       c,
+		client:  kube.CoreV1(),
+		allowed: allowed,
+	}, nil
+}
+
+// ServeHTTP handles /mint?service_account=<name>&audience=<aud>&expiration=<seconds>, every parameter is
+// optional and defaults to the service account of the pod and the defaults of the api server.
+func (m *minter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	var expiration int64
+	if value := query.Get("expiration"); value != "" {
+		var err error
+		expiration, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || expiration < tokensource.MinExpirationSeconds {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("expiration must be an integer of at least %d seconds", tokensource.MinExpirationSeconds))
+			return
+		}
+	}
+
+	// the projected token of the pod tells us who and where we are
+	own, err := readPayload(m.c, m.c.Path("path"))
+	if err != nil {
+		logrus.WithError(err).Error("unable to read token")
+		writeError(w, http.StatusInternalServerError, "unable to read token")
+		return
+	}
+
+	namespace := strings.TrimSpace(own.Namespace)
+
+	var self string
+	if claims, err := tokensource.ParseClaims(own.Contents); err == nil {
+		if ns, sa, ok := claims.ServiceAccount(); ok {
+			if namespace == "" {
+				namespace = ns
+			}
+			self = sa
+		}
+	}
+
+	if namespace == "" || self == "" {
+		logrus.Error("unable to determine the service account of the pod")
+		writeError(w, http.StatusInternalServerError, "unable to determine the service account of the pod")
+		return
+	}
+
+	name := query.Get("service_account")
+	if name == "" {
+		name = self
+	}
+
+	if !m.allows(self, name) {
+		logrus.WithField("service-account", name).Warn("refusing to mint token")
+		writeError(w, http.StatusForbidden, fmt.Sprintf("minting tokens for %q is not allowed", name))
+		return
+	}
+
+	source := &tokensource.TokenRequestSource{
+		Client:             m.client,
+		Namespace:          namespace,
+		ServiceAccountName: name,
+		ExpirationSeconds:  expiration,
+	}
+	if audience := query.Get("audience"); audience != "" {
+		source.Audiences = []string{audience}
+	}
+
+	token, err := source.Token(r.Context())
+	if err != nil {
+		logrus.WithError(err).Error("unable to mint token")
+
+		code := http.StatusInternalServerError
+		switch {
+		case apierrors.IsNotFound(err):
+			code = http.StatusNotFound
+		case apierrors.IsForbidden(err):
+			code = http.StatusForbidden
+		case apierrors.IsBadRequest(err), apierrors.IsInvalid(err):
+			code = http.StatusBadRequest
+		}
+
+		writeError(w, code, err.Error())
+		return
+	}
+
+	payload := &tokensource.Payload{
+		Contents:  token.Contents,
+		CACert:    own.CACert,
+		Namespace: namespace,
+	}
+
+	writeToken(w, r, payload)
+}
+
+// allows returns whether tokens may be minted for the service account name, the own service account of the pod
+// and those given with --mint-service-account.
+func (m *minter) allows(self, name string) bool {
+	return name == self || m.allowed[name]
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"encoding/base64"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/urfave/cli/v2"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestMinter(t *testing.T) {
+	// the projected token of the pod, for the service account app in namespace default
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"system:serviceaccount:default:app"}`))
+	path := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(path, []byte("eyJhbGciOiJSUzI1NiJ9."+payload+".c2ln"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	set := flag.NewFlagSet("server", flag.ContinueOnError)
+	set.String("path", path, "")
+	c := cli.NewContext(cli.NewApp(), set, nil)
+
+	tests := []struct {
+		name     string
+		query    string
+		wantCode int
+		wantSA   string
+	}{
+		{name: "own", query: "audience=vault", wantCode: http.StatusOK, wantSA: "app"},
+		{name: "own by name", query: "service_account=app", wantCode: http.StatusOK, wantSA: "app"},
+		{name: "allowed", query: "service_account=worker", wantCode: http.StatusOK, wantSA: "worker"},
+		{name: "not allowed", query: "service_account=admin", wantCode: http.StatusForbidden},
+		{name: "empty name isn't allowed", query: "service_account=+", wantCode: http.StatusForbidden},
+		{name: "expiration too short", query: "expiration=599", wantCode: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var minted []string
+
+			client := fake.NewSimpleClientset()
+			client.PrependReactor("create", "serviceaccounts", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				create := action.(k8stesting.CreateActionImpl)
+				if action.GetSubresource() != "token" || action.GetNamespace() != "default" {
+					t.Errorf("unexpected %s of %s in %s", action.GetVerb(), action.GetSubresource(), action.GetNamespace())
+				}
+				minted = append(minted, create.Name)
+
+				return true, &authenticationv1.TokenRequest{
+					Status: authenticationv1.TokenRequestStatus{Token: "minted-for-" + create.Name},
+				}, nil
+			})
+
+			m := &minter{
+				c:       c,
+				client:  client.CoreV1(),
+				allowed: map[string]bool{"worker": true},
+			}
+
+			r := httptest.NewRequest("GET", "/v1/mint?"+tt.query, nil)
+			r.Header.Set("Accept", contentTypeText)
+			w := httptest.NewRecorder()
+			m.ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+
+			if tt.wantSA == "" {
+				if len(minted) != 0 {
+					t.Errorf("minted tokens for %q, want none", minted)
+				}
+				return
+			}
+
+			if len(minted) != 1 || minted[0] != tt.wantSA {
+				t.Errorf("minted tokens for %q, want %s", minted, tt.wantSA)
+			}
+			if got := w.Body.String(); got != "minted-for-"+tt.wantSA {
+				t.Errorf("body = %q, want the token minted for %s", got, tt.wantSA)
+			}
+		})
+	}
+}
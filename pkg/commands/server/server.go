@@ -2,41 +2,58 @@ package server
 
 import (
 	"context"
+	"fmt"
 	"github.com/ekristen/satokens/pkg/commands/global"
 	"github.com/ekristen/satokens/pkg/common"
+	"github.com/ekristen/satokens/pkg/tokensource"
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
-	"k8s.io/apimachinery/pkg/util/json"
+	"net"
 	"net/http"
 	"os"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
-type Payload struct {
-	Contents []byte `json:"contents"`
-}
-
 func Execute(c *cli.Context) error {
+	tokens, err := parseTokenPaths(c.StringSlice("token"))
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for name := range tokens {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	api := newAPI(c, tokens, names)
+
 	router := mux.NewRouter().StrictSlash(true)
-	router.Path("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		data, err := os.ReadFile(c.Path("path"))
+	api.register(router)
+
+	go api.watch(c.Context)
+
+	if c.Bool("mint") {
+		minter, err := newMinter(c)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+			return err
 		}
 
-		if err := json.NewEncoder(w).Encode(Payload{
-			Contents: data,
-		}); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-	})
+		router.Path("/mint").Handler(minter)
+		router.Path("/v1/mint").Handler(minter)
+	}
 
 	srv := &http.Server{
 		Addr:    c.String("addr"),
 		Handler: router,
+		// ends the token streams on shutdown, which would otherwise keep it waiting
+		BaseContext: func(net.Listener) context.Context {
+			return c.Context
+		},
 	}
 
 	go func() {
@@ -63,6 +80,76 @@ func Execute(c *cli.Context) error {
 	return nil
 }
 
+// readPayload reads the token at path along with the ca.crt and namespace shared by all tokens.
+func readPayload(c *cli.Context, path string) (*tokensource.Payload, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := &tokensource.Payload{
+		Contents: data,
+	}
+
+	if c.Path("ca-path") != "" {
+		payload.CACert, err = os.ReadFile(c.Path("ca-path"))
+		warnOptional(c.Path("ca-path"), err)
+	}
+
+	if c.Path("namespace-path") != "" {
+		namespace, err := os.ReadFile(c.Path("namespace-path"))
+		warnOptional(c.Path("namespace-path"), err)
+		payload.Namespace = string(namespace)
+	}
+
+	return payload, nil
+}
+
+// unreadable holds the optional files that couldn't be read, so that every token served doesn't warn again.
+var (
+	unreadableMu sync.Mutex
+	unreadable   = map[string]bool{}
+)
+
+// warnOptional warns about the optional file at path that couldn't be read, only the first time in a row.
+func warnOptional(path string, err error) {
+	unreadableMu.Lock()
+	defer unreadableMu.Unlock()
+
+	if err == nil {
+		delete(unreadable, path)
+		return
+	}
+
+	if unreadable[path] {
+		logrus.WithError(err).Debugf("unable to read %s", path)
+		return
+	}
+	unreadable[path] = true
+
+	logrus.WithError(err).Warnf("unable to read %s, serving tokens without it", path)
+}
+
+// parseTokenPaths parses the name=path pairs of the additional tokens to serve.
+func parseTokenPaths(specs []string) (map[string]string, error) {
+	tokens := make(map[string]string, len(specs))
+
+	for _, spec := range specs {
+		name, path, ok := strings.Cut(spec, "=")
+		if !ok || name == "" || path == "" {
+			return nil, fmt.Errorf("invalid token %q, expected name=path", spec)
+		}
+
+		if _, exists := tokens[name]; exists {
+			return nil, fmt.Errorf("duplicate token name %q", name)
+		}
+
+		tokens[name] = path
+	}
+
+	return tokens, nil
+}
+
 func init() {
 	flags := []cli.Flag{
 		&cli.StringFlag{
@@ -70,6 +157,28 @@ func init() {
 			Usage: "the path to the token file",
 			Value: "",
 		},
+		&cli.StringSliceFlag{
+			Name:  "token",
+			Usage: "additional token to serve under /tokens/<name>, in the form name=path (repeatable)",
+		},
+		&cli.StringFlag{
+			Name:  "ca-path",
+			Usage: "the path to the cluster ca certificate",
+			Value: "",
+		},
+		&cli.StringFlag{
+			Name:  "namespace-path",
+			Usage: "the path to the file containing the pod namespace",
+			Value: "",
+		},
+		&cli.BoolFlag{
+			Name:  "mint",
+			Usage: "mint tokens for service accounts in the namespace under /mint with the token request api, requires the role created by deploy --mint",
+		},
+		&cli.StringSliceFlag{
+			Name:  "mint-service-account",
+			Usage: "other service account /mint may mint tokens for, besides the one of the pod (repeatable)",
+		},
 		&cli.StringFlag{
 			Name:  "addr",
 			Usage: "the address to host the server on",
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"github.com/ekristen/satokens/pkg/tokensource"
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+	"io"
+	"k8s.io/apimachinery/pkg/util/json"
+	"net/http"
+	"path/filepath"
+	"time"
+)
+
+// pollInterval is how often the tokens are read regardless of the events of the directories holding them, in
+// case those are missed or can't be watched at all.
+const pollInterval = time.Minute
+
+// watch reads every token whenever something changes in the directories holding them, and every pollInterval,
+// until ctx is done. Kubelet rotates them by swapping the ..data symlink of the projected volume, which shows up
+// as events of the volume directory. read wakes up the streams when one rotated.
+func (a *api) watch(ctx context.Context) {
+	paths := []string{a.c.Path("path")}
+	for _, name := range a.names {
+		paths = append(paths, a.tokens[name])
+	}
+
+	var events <-chan fsnotify.Event
+	var watchErrors <-chan error
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logrus.WithError(err).Warnf("unable to watch the tokens, reading them every %s instead", pollInterval)
+	} else {
+		defer watcher.Close()
+
+		dirs := map[string]bool{}
+		for _, path := range paths {
+			dir := filepath.Dir(path)
+			if dirs[dir] {
+				continue
+			}
+			dirs[dir] = true
+
+			if err := watcher.Add(dir); err != nil {
+				logrus.WithError(err).Warnf("unable to watch %s, reading its tokens every %s instead", dir, pollInterval)
+			}
+		}
+
+		events, watchErrors = watcher.Events, watcher.Errors
+	}
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, path := range paths {
+			if _, err := a.read(path); err != nil {
+				logrus.WithError(err).Debugf("unable to read %s", path)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-events:
+			logrus.WithField("event", event).Debug("token directory changed")
+		case err := <-watchErrors:
+			logrus.WithError(err).Warn("error watching the tokens")
+		case <-ticker.C:
+		}
+	}
+}
+
+// stream handles /v1/watch?name=<name>, pushing the token called name (the default token when empty) as
+// server-sent events, the current one right away and every rotation after it until the client goes away.
+func (a *api) stream(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+
+	path := a.c.Path("path")
+	if name != "" {
+		var ok bool
+		if path, ok = a.tokens[name]; !ok {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("unknown token %q", name))
+			return
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(tokensource.WatchKeepAlive)
+	defer keepAlive.Stop()
+
+	var sent [sha256.Size]byte
+
+	for {
+		// taken before reading, so that a rotation in between isn't missed
+		a.mu.Lock()
+		rotated := a.rotated
+		a.mu.Unlock()
+
+		payload, err := a.read(path)
+		if err != nil {
+			logrus.WithError(err).Errorf("unable to read token %s", path)
+		} else if sum := sha256.Sum256(payload.Contents); sum != sent {
+			if name == "" {
+				payload.Tokens = a.names
+			}
+
+			if err := writeEvent(w, "token", payload); err != nil {
+				return
+			}
+			flusher.Flush()
+
+			sent = sum
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-rotated:
+		case <-keepAlive.C:
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func writeEvent(w io.Writer, event string, data interface{}) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, body)
+	return err
+}
@@ -0,0 +1,136 @@
+package sync
+
+import (
+	"fmt"
+	"github.com/ekristen/satokens/pkg/commands/backend"
+	"github.com/ekristen/satokens/pkg/commands/global"
+	"github.com/ekristen/satokens/pkg/common"
+	"github.com/ekristen/satokens/pkg/tokenfile"
+	"github.com/ekristen/satokens/pkg/tokensource"
+	"github.com/rancher/wrangler/pkg/kubeconfig"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+	"k8s.io/client-go/kubernetes"
+	"os"
+	"strconv"
+)
+
+func Before(c *cli.Context) error {
+	if err := global.Before(c); err != nil {
+		return err
+	}
+
+	if c.Args().Len() == 1 {
+		c.Set("output", c.Args().First())
+	}
+
+	return nil
+}
+
+func Execute(c *cli.Context) error {
+	mode, err := strconv.ParseUint(c.String("file-mode"), 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid file mode %q: %w", c.String("file-mode"), err)
+	}
+
+	cfg, err := kubeconfig.GetNonInteractiveClientConfig(c.String("kubeconfig")).ClientConfig()
+	if err != nil {
+		return err
+	}
+
+	kube, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	source, _, err := backend.New(c.Context, c, cfg, kube)
+	if err != nil {
+		return err
+	}
+
+	if name := c.String("token-name"); name != "" {
+		named, ok := source.(tokensource.NamedSource)
+		if !ok {
+			return fmt.Errorf("the %s backend only provides the default token", c.String("backend"))
+		}
+		source = named.Named(name)
+	}
+
+	cache := tokensource.NewCache(source, backend.CacheConfig(c))
+
+	writer := &tokenfile.Writer{
+		Path:  c.Path("output"),
+		Cache: cache,
+		Mode:  os.FileMode(mode),
+	}
+
+	if c.IsSet("uid") {
+		writer.UID = &[]int{c.Int("uid")}[0]
+	}
+	if c.IsSet("gid") {
+		writer.GID = &[]int{c.Int("gid")}[0]
+	}
+
+	if c.Bool("once") {
+		return writer.Sync(c.Context)
+	}
+
+	go cache.Run(c.Context)
+	go cache.Watch(c.Context)
+
+	logrus.WithField("path", writer.Path).Info("syncing token")
+
+	writer.Run(c.Context)
+
+	return nil
+}
+
+func init() {
+	flags := []cli.Flag{
+		&cli.PathFlag{
+			Name:     "output",
+			Usage:    "the file to write the token to",
+			Aliases:  []string{"o"},
+			EnvVars:  []string{"OUTPUT"},
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:    "token-name",
+			Usage:   "write one of the additional tokens of the pod instead of the default one",
+			EnvVars: []string{"TOKEN_NAME"},
+		},
+		&cli.StringFlag{
+			Name:    "file-mode",
+			Usage:   "permissions of the token file, in octal",
+			EnvVars: []string{"FILE_MODE"},
+			Value:   "0600",
+		},
+		&cli.IntFlag{
+			Name:    "uid",
+			Usage:   "owner of the token file, defaults to the current user",
+			EnvVars: []string{"FILE_UID"},
+		},
+		&cli.IntFlag{
+			Name:    "gid",
+			Usage:   "group of the token file, defaults to the current group",
+			EnvVars: []string{"FILE_GID"},
+		},
+		&cli.BoolFlag{
+			Name:  "once",
+			Usage: "write the token once and exit instead of keeping it in sync",
+		},
+	}
+
+	cliCmd := &cli.Command{
+		Name:  "sync",
+		Usage: "keep the token in sync with a regular file, for when fuse is not available",
+		Description: `The sync command fetches the token the same way mount does but writes it to a regular file instead of
+serving it from a fuse filesystem. The file is replaced atomically (write to a temporary file, then rename) every time
+the token is refreshed, which happens before it expires.`,
+		Action: Execute,
+		Flags:  append(append(flags, backend.Flags()...), global.Flags()...),
+		Before: Before,
+	}
+
+	common.RegisterCommand(cliCmd)
+}
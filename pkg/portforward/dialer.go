@@ -0,0 +1,265 @@
+package portforward
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+)
+
+// Dialer is a portForwarder that never listens on a local port. Instead it holds the port-forward connection
+// to the pod and opens a stream on it for every DialContext, so it can be used as the DialContext of an
+// http.Transport and nothing else on the machine can reach the pod through it.
+type Dialer struct {
+	mu        sync.Mutex
+	conn      httpstream.Connection // GUARDED_BY(mu)
+	requestID int                   // GUARDED_BY(mu)
+}
+
+// ForwardPorts establishes the connection to the pod and holds it until it is lost or the stop channel is
+// closed. The ports of the options are ignored, the port is taken from the address passed to DialContext.
+func (d *Dialer) ForwardPorts(method string, url *url.URL, opts PortForwardOptions) error {
+	transport, upgrader, err := spdy.RoundTripperFor(opts.Config)
+	if err != nil {
+		logrus.WithError(err).Error("unable to setup spdy roundtripper")
+		return err
+	}
+
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, method, url)
+	conn, _, err := dialer.Dial(portforward.PortForwardProtocolV1Name)
+	if err != nil {
+		return fmt.Errorf("error upgrading connection: %w", err)
+	}
+	defer conn.Close()
+
+	d.setConn(conn)
+	defer d.setConn(nil)
+
+	if opts.ReadyChannel != nil {
+		close(opts.ReadyChannel)
+	}
+
+	select {
+	case <-opts.StopChannel:
+	case <-conn.CloseChan():
+	}
+
+	return nil
+}
+
+// DialContext opens a stream to the port of addr on the pod, the host part of addr is ignored.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	_, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q: %w", portString, err)
+	}
+
+	d.mu.Lock()
+	conn := d.conn
+	d.requestID++
+	requestID := d.requestID
+	d.mu.Unlock()
+
+	if conn == nil {
+		return nil, ErrNotConnected
+	}
+
+	headers := http.Header{}
+	headers.Set(v1.StreamType, v1.StreamTypeError)
+	headers.Set(v1.PortHeader, strconv.FormatUint(port, 10))
+	headers.Set(v1.PortForwardRequestIDHeader, strconv.Itoa(requestID))
+
+	errorStream, err := conn.CreateStream(headers)
+	if err != nil {
+		return nil, fmt.Errorf("error creating error stream for port %d: %w", port, err)
+	}
+	// we're not writing to this stream
+	errorStream.Close()
+
+	headers.Set(v1.StreamType, v1.StreamTypeData)
+	dataStream, err := conn.CreateStream(headers)
+	if err != nil {
+		conn.RemoveStreams(errorStream)
+		return nil, fmt.Errorf("error creating data stream for port %d: %w", port, err)
+	}
+
+	sc := &streamConn{
+		conn:        conn,
+		dataStream:  dataStream,
+		errorStream: errorStream,
+		remoteErr:   make(chan error, 1),
+		addr:        streamAddr(addr),
+	}
+
+	go func() {
+		message, err := io.ReadAll(errorStream)
+		switch {
+		case err != nil:
+			sc.remoteErr <- fmt.Errorf("error reading from error stream for port %d: %w", port, err)
+		case len(message) > 0:
+			sc.remoteErr <- fmt.Errorf("an error occurred forwarding to port %d: %s", port, message)
+		}
+		close(sc.remoteErr)
+	}()
+
+	return sc, nil
+}
+
+func (d *Dialer) setConn(conn httpstream.Connection) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.conn = conn
+}
+
+// streamConn adapts a port-forward data stream to a net.Conn.
+type streamConn struct {
+	conn        httpstream.Connection
+	dataStream  httpstream.Stream
+	errorStream httpstream.Stream
+	remoteErr   chan error
+	addr        streamAddr
+
+	readDeadline  deadline
+	writeDeadline deadline
+
+	closeOnce sync.Once
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	if c.readDeadline.exceeded() {
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	n, err := c.dataStream.Read(b)
+	if err != nil {
+		if c.readDeadline.exceeded() {
+			return n, os.ErrDeadlineExceeded
+		}
+
+		// the pod reports failures, like nothing listening on the port, on the error stream
+		select {
+		case remoteErr, ok := <-c.remoteErr:
+			if ok && remoteErr != nil {
+				return n, remoteErr
+			}
+		default:
+		}
+	}
+
+	return n, err
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	if c.writeDeadline.exceeded() {
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	n, err := c.dataStream.Write(b)
+	if err != nil && c.writeDeadline.exceeded() {
+		return n, os.ErrDeadlineExceeded
+	}
+
+	return n, err
+}
+
+// Close resets the streams, closing them would only half-close them and leave a blocked Read hanging.
+func (c *streamConn) Close() error {
+	var err error
+
+	c.closeOnce.Do(func() {
+		c.readDeadline.stop()
+		c.writeDeadline.stop()
+
+		err = c.dataStream.Reset()
+		_ = c.errorStream.Reset()
+		c.conn.RemoveStreams(c.dataStream, c.errorStream)
+	})
+
+	return err
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return c.addr }
+func (c *streamConn) RemoteAddr() net.Addr { return c.addr }
+
+// The streams can't be interrupted other than by resetting them, so a deadline that passes closes the conn for
+// good, extending it afterwards doesn't bring the conn back.
+func (c *streamConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t, c.expire)
+	c.writeDeadline.set(t, c.expire)
+	return nil
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t, c.expire)
+	return nil
+}
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t, c.expire)
+	return nil
+}
+
+func (c *streamConn) expire() {
+	_ = c.Close()
+}
+
+// deadline calls expire once it passes, unless it is changed before.
+type deadline struct {
+	mu    sync.Mutex
+	timer *time.Timer // GUARDED_BY(mu)
+	t     time.Time   // GUARDED_BY(mu)
+}
+
+func (d *deadline) set(t time.Time, expire func()) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+
+	d.t = t
+	if !t.IsZero() {
+		d.timer = time.AfterFunc(time.Until(t), expire)
+	}
+}
+
+func (d *deadline) stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+}
+
+func (d *deadline) exceeded() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return !d.t.IsZero() && !time.Now().Before(d.t)
+}
+
+type streamAddr string
+
+func (a streamAddr) Network() string { return "portforward" }
+func (a streamAddr) String() string  { return string(a) }
@@ -0,0 +1,149 @@
+package portforward
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/apimachinery/pkg/util/httpstream/spdy"
+)
+
+// dialPipe returns a conn dialed over an in-memory spdy connection and the data stream the pod side sees for
+// it.
+func dialPipe(t *testing.T) (net.Conn, httpstream.Stream) {
+	t.Helper()
+
+	client, server := net.Pipe()
+
+	streams := make(chan httpstream.Stream, 2)
+	serverConn, err := spdy.NewServerConnection(server, func(stream httpstream.Stream, replySent <-chan struct{}) error {
+		streams <- stream
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { serverConn.Close() })
+
+	clientConn, err := spdy.NewClientConnection(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { clientConn.Close() })
+
+	d := &Dialer{}
+	d.setConn(clientConn)
+
+	conn, err := d.DialContext(context.Background(), "tcp", "satokens:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case stream := <-streams:
+			if stream.Headers().Get(v1.StreamType) == v1.StreamTypeData {
+				return conn, stream
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("streams weren't created")
+		}
+	}
+
+	t.Fatal("no data stream")
+	return nil, nil
+}
+
+func TestStreamConnRead(t *testing.T) {
+	conn, pod := dialPipe(t)
+	defer conn.Close()
+
+	go func() {
+		_, _ = pod.Write([]byte("ok"))
+	}()
+
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	if string(buf) != "ok" {
+		t.Errorf("Read() = %q, want %q", buf, "ok")
+	}
+}
+
+func TestStreamConnUnblocksRead(t *testing.T) {
+	tests := []struct {
+		name    string
+		unblock func(conn net.Conn)
+		wantErr error
+	}{
+		{
+			name:    "close",
+			unblock: func(conn net.Conn) { conn.Close() },
+			wantErr: io.EOF,
+		},
+		{
+			name:    "read deadline",
+			unblock: func(conn net.Conn) { _ = conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond)) },
+			wantErr: os.ErrDeadlineExceeded,
+		},
+		{
+			name:    "deadline",
+			unblock: func(conn net.Conn) { _ = conn.SetDeadline(time.Now().Add(10 * time.Millisecond)) },
+			wantErr: os.ErrDeadlineExceeded,
+		},
+		{
+			name:    "past deadline",
+			unblock: func(conn net.Conn) { _ = conn.SetReadDeadline(time.Now().Add(-time.Second)) },
+			wantErr: os.ErrDeadlineExceeded,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, _ := dialPipe(t)
+			defer conn.Close()
+
+			done := make(chan error, 1)
+			go func() {
+				_, err := conn.Read(make([]byte, 1))
+				done <- err
+			}()
+
+			tt.unblock(conn)
+
+			select {
+			case err := <-done:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("Read() error = %v, want %v", err, tt.wantErr)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Read() is still blocked")
+			}
+		})
+	}
+}
+
+func TestStreamConnExtendedDeadline(t *testing.T) {
+	conn, pod := dialPipe(t)
+	defer conn.Close()
+
+	// a deadline moved out before it passes doesn't close the conn
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_ = conn.SetReadDeadline(time.Time{})
+	time.Sleep(20 * time.Millisecond)
+
+	go func() {
+		_, _ = pod.Write([]byte("ok"))
+	}()
+
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+		t.Errorf("Read() error = %v", err)
+	}
+}
@@ -6,15 +6,16 @@ import (
 	"github.com/sirupsen/logrus"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/cli-runtime/pkg/genericclioptions"
 	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/portforward"
 	"k8s.io/client-go/transport/spdy"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
-	"os/signal"
 )
 
 /*
@@ -33,11 +34,17 @@ type PortForwardOptions struct {
 	PortForwarder portForwarder
 	StopChannel   chan struct{}
 	ReadyChannel  chan struct{}
+
+	// Status, when set, is kept up to date by Supervise.
+	Status *Status
+	// Backoff between reconnect attempts made by Supervise, DefaultBackoff is used when unset.
+	Backoff wait.Backoff
 }
 
-// RunPortForward implements all the necessary functionality for port-forward cmd.
-func (o PortForwardOptions) RunPortForward() error {
-	pod, err := o.PodClient.Pods(o.Namespace).Get(context.TODO(), o.PodName, metav1.GetOptions{})
+// RunPortForward implements all the necessary functionality for port-forward cmd. The forward is
+// stopped when ctx is done.
+func (o PortForwardOptions) RunPortForward(ctx context.Context) error {
+	pod, err := o.PodClient.Pods(o.Namespace).Get(ctx, o.PodName, metav1.GetOptions{})
 	if err != nil {
 		logrus.WithError(err).Error("unable ot get pod")
 		return err
@@ -47,14 +54,16 @@ func (o PortForwardOptions) RunPortForward() error {
 		return fmt.Errorf("unable to forward port because pod is not running. Current status=%v", pod.Status.Phase)
 	}
 
-	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, os.Interrupt)
-	defer signal.Stop(signals)
+	finished := make(chan struct{})
+	defer close(finished)
 
 	go func() {
-		<-signals
-		if o.StopChannel != nil {
-			close(o.StopChannel)
+		select {
+		case <-ctx.Done():
+			if o.StopChannel != nil {
+				close(o.StopChannel)
+			}
+		case <-finished:
 		}
 	}()
 
@@ -67,6 +76,18 @@ func (o PortForwardOptions) RunPortForward() error {
 	return o.PortForwarder.ForwardPorts("POST", req.URL(), o)
 }
 
+// FreePort asks the OS for an unused local port on address. The port is released before returning, so the
+// port-forward can bind it and keep binding the same port across reconnects.
+func FreePort(address string) (int, error) {
+	listener, err := net.Listen("tcp", net.JoinHostPort(address, "0"))
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
+
 type portForwarder interface {
 	ForwardPorts(method string, url *url.URL, opts PortForwardOptions) error
 }
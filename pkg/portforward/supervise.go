@@ -0,0 +1,248 @@
+package portforward
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// DefaultBackoff is used between reconnect attempts when PortForwardOptions.Backoff is not set.
+var DefaultBackoff = wait.Backoff{
+	Duration: time.Second,
+	Factor:   2,
+	Jitter:   0.1,
+	Steps:    10,
+	Cap:      time.Minute,
+}
+
+// ErrNotConnected is returned by Status.Err while the port-forward is not established.
+var ErrNotConnected = errors.New("port-forward to the satokens pod is not connected")
+
+var errLostConnection = errors.New("lost connection to pod")
+
+// State of a supervised port-forward.
+type State int
+
+const (
+	StateConnecting State = iota
+	StateConnected
+	StateDisconnected
+)
+
+func (s State) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	default:
+		return "unknown"
+	}
+}
+
+// Status tracks the state of a supervised port-forward, it is safe for concurrent use.
+type Status struct {
+	mu        sync.RWMutex
+	state     State
+	err       error
+	since     time.Time
+	changed   chan struct{}
+	reconnect chan struct{}
+}
+
+// State returns the current state, the last error seen while not connected and when the state last changed.
+func (s *Status) State() (State, error, time.Time) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.state, s.err, s.since
+}
+
+// Err returns nil while connected, so callers can fail fast instead of waiting on a dead tunnel.
+func (s *Status) Err() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.state == StateConnected {
+		return nil
+	}
+
+	if s.err != nil {
+		return fmt.Errorf("%w: %v", ErrNotConnected, s.err)
+	}
+
+	return ErrNotConnected
+}
+
+// Ready is like Err, except that while connecting it waits for the attempt to finish (or ctx to be done) rather
+// than failing right away.
+func (s *Status) Ready(ctx context.Context) error {
+	for {
+		s.mu.Lock()
+		if s.state != StateConnecting {
+			s.mu.Unlock()
+			return s.Err()
+		}
+		if s.changed == nil {
+			s.changed = make(chan struct{})
+		}
+		changed := s.changed
+		s.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// Changed returns a channel that is closed on the next change of state.
+func (s *Status) Changed() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.changed == nil {
+		s.changed = make(chan struct{})
+	}
+
+	return s.changed
+}
+
+// String describes the current state, e.g. "connected since 2006-01-02T15:04:05Z".
+func (s *Status) String() string {
+	state, err, since := s.State()
+
+	if err != nil && state != StateConnected {
+		return fmt.Sprintf("%s since %s: %v", state, since.UTC().Format(time.RFC3339), err)
+	}
+
+	return fmt.Sprintf("%s since %s", state, since.UTC().Format(time.RFC3339))
+}
+
+// Reconnect drops the current connection, or attempt to connect, and has Supervise reconnect right away.
+func (s *Status) Reconnect() {
+	select {
+	case s.reconnects() <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Status) reconnects() chan struct{} {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.reconnect == nil {
+		s.reconnect = make(chan struct{}, 1)
+	}
+
+	return s.reconnect
+}
+
+func (s *Status) set(state State, err error) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.state = state
+	s.err = err
+	s.since = time.Now()
+
+	if s.changed != nil {
+		close(s.changed)
+		s.changed = nil
+	}
+}
+
+// Supervise runs the port-forward until ctx is done, re-resolving the pod and reconnecting with
+// exponential backoff whenever the connection is lost or can't be established. The StopChannel and
+// ReadyChannel of the options are replaced on every attempt.
+func (o PortForwardOptions) Supervise(ctx context.Context) error {
+	initial := o.Backoff
+	if initial.Steps == 0 {
+		initial = DefaultBackoff
+	}
+	backoff := initial
+	reconnect := o.Status.reconnects()
+
+	for {
+		o.Status.set(StateConnecting, nil)
+
+		attempt := o
+		attempt.StopChannel = make(chan struct{}, 1)
+		attempt.ReadyChannel = make(chan struct{})
+
+		attemptCtx, cancelAttempt := context.WithCancel(ctx)
+
+		done := make(chan error, 1)
+		go func() {
+			done <- attempt.RunPortForward(attemptCtx)
+		}()
+
+		var err error
+		var requested bool
+		select {
+		case <-attempt.ReadyChannel:
+			logrus.Info("connected to satokens pod")
+			o.Status.set(StateConnected, nil)
+			backoff = initial
+
+			select {
+			case err = <-done:
+			case <-reconnect:
+				requested = true
+			}
+		case err = <-done:
+		case <-reconnect:
+			requested = true
+		}
+
+		if requested {
+			cancelAttempt()
+			<-done
+		}
+		cancelAttempt()
+
+		if ctx.Err() != nil {
+			o.Status.set(StateDisconnected, ctx.Err())
+			return nil
+		}
+
+		if requested {
+			logrus.Info("reconnecting to satokens pod on request")
+			backoff = initial
+			continue
+		}
+
+		if err == nil {
+			err = errLostConnection
+		}
+
+		o.Status.set(StateDisconnected, err)
+
+		delay := backoff.Step()
+		logrus.WithError(err).Warnf("port-forward to satokens pod is down, reconnecting in %s", delay.Round(time.Millisecond))
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+	}
+}
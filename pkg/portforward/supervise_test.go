@@ -0,0 +1,212 @@
+package portforward
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+	fakerest "k8s.io/client-go/rest/fake"
+)
+
+// fakeForwarder connects the attempts it is told to and holds each connection until it is dropped or stopped.
+type fakeForwarder struct {
+	fail func(attempt int) error
+
+	mu       sync.Mutex
+	attempts int
+	drop     chan struct{}
+}
+
+func (f *fakeForwarder) ForwardPorts(method string, url *url.URL, opts PortForwardOptions) error {
+	f.mu.Lock()
+	f.attempts++
+	attempt := f.attempts
+	drop := make(chan struct{})
+	f.drop = drop
+	f.mu.Unlock()
+
+	if f.fail != nil {
+		if err := f.fail(attempt); err != nil {
+			return err
+		}
+	}
+
+	close(opts.ReadyChannel)
+
+	select {
+	case <-opts.StopChannel:
+		return nil
+	case <-drop:
+		return errLostConnection
+	}
+}
+
+func (f *fakeForwarder) Attempts() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.attempts
+}
+
+// Drop loses the current connection.
+func (f *fakeForwarder) Drop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	close(f.drop)
+}
+
+func TestSupervise(t *testing.T) {
+	tests := []struct {
+		name         string
+		fail         func(attempt int) error
+		interrupt    func(f *fakeForwarder, s *Status)
+		wantAttempts int
+	}{
+		{
+			name:         "connects",
+			wantAttempts: 1,
+		},
+		{
+			name: "retries failed attempts",
+			fail: func(attempt int) error {
+				if attempt < 3 {
+					return errors.New("unavailable")
+				}
+				return nil
+			},
+			wantAttempts: 3,
+		},
+		{
+			name:         "reconnects when the connection is lost",
+			interrupt:    func(f *fakeForwarder, s *Status) { f.Drop() },
+			wantAttempts: 2,
+		},
+		{
+			name:         "reconnects on request",
+			interrupt:    func(f *fakeForwarder, s *Status) { s.Reconnect() },
+			wantAttempts: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "satokens", Name: "satokens"},
+				Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+			}
+
+			forwarder := &fakeForwarder{fail: tt.fail}
+			status := &Status{}
+
+			opts := PortForwardOptions{
+				Namespace:     pod.Namespace,
+				PodName:       pod.Name,
+				RESTClient:    &fakerest.RESTClient{},
+				PodClient:     fake.NewSimpleClientset(pod).CoreV1(),
+				PortForwarder: forwarder,
+				Status:        status,
+				Backoff:       wait.Backoff{Duration: time.Millisecond, Factor: 1, Steps: 1},
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			done := make(chan error, 1)
+			go func() {
+				done <- opts.Supervise(ctx)
+			}()
+
+			connected := func() bool {
+				state, _, _ := status.State()
+				return state == StateConnected
+			}
+
+			waitFor(t, connected)
+
+			if tt.interrupt != nil {
+				tt.interrupt(forwarder, status)
+				waitFor(t, func() bool { return forwarder.Attempts() == tt.wantAttempts && connected() })
+			}
+
+			if err := status.Err(); err != nil {
+				t.Errorf("Err() = %v, want nil", err)
+			}
+
+			cancel()
+			if err := <-done; err != nil {
+				t.Errorf("Supervise() error = %v, want nil", err)
+			}
+
+			if attempts := forwarder.Attempts(); attempts != tt.wantAttempts {
+				t.Errorf("%d attempts, want %d", attempts, tt.wantAttempts)
+			}
+			if state, _, _ := status.State(); state != StateDisconnected {
+				t.Errorf("State() = %s after ctx is done, want %s", state, StateDisconnected)
+			}
+			if err := status.Err(); !errors.Is(err, ErrNotConnected) {
+				t.Errorf("Err() = %v after ctx is done, want %v", err, ErrNotConnected)
+			}
+		})
+	}
+}
+
+func TestStatusReady(t *testing.T) {
+	tests := []struct {
+		name    string
+		state   State
+		wantErr error
+	}{
+		{name: "connected", state: StateConnected},
+		{name: "disconnected", state: StateDisconnected, wantErr: ErrNotConnected},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := &Status{}
+			status.set(StateConnecting, nil)
+
+			done := make(chan error, 1)
+			go func() {
+				done <- status.Ready(context.Background())
+			}()
+
+			// Ready waits while connecting
+			select {
+			case err := <-done:
+				t.Fatalf("Ready() = %v while connecting, want it to wait", err)
+			case <-time.After(10 * time.Millisecond):
+			}
+
+			status.set(tt.state, nil)
+
+			select {
+			case err := <-done:
+				if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+					t.Errorf("Ready() = %v, want %v", err, tt.wantErr)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Ready() didn't return on a change of state")
+			}
+		})
+	}
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,126 @@
+package tokenfile
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ekristen/satokens/pkg/tokensource"
+	"github.com/sirupsen/logrus"
+)
+
+const retryInterval = 5 * time.Second
+
+// Writer keeps a regular file in sync with the token of a cache. Every write goes to a temporary file in the
+// same directory that is then renamed over the target, so readers never see a partial token.
+type Writer struct {
+	Path  string
+	Cache *tokensource.Cache
+
+	// Mode of the file, 0600 when unset.
+	Mode os.FileMode
+	// UID and GID to chown the file to, left as the current user when nil.
+	UID *int
+	GID *int
+
+	written []byte
+}
+
+// Sync writes the current token if it differs from what was last written.
+func (w *Writer) Sync(ctx context.Context) error {
+	token, err := w.Cache.Token(ctx)
+	if err != nil {
+		return err
+	}
+
+	if w.written != nil && bytes.Equal(w.written, token.Contents) {
+		return nil
+	}
+
+	if err := w.write(token.Contents); err != nil {
+		return err
+	}
+
+	w.written = token.Contents
+
+	logrus.WithField("path", w.Path).WithField("expires", token.ExpiresAt()).Debug("wrote token")
+
+	return nil
+}
+
+// Run re-syncs the file every time the cache picks up a new token until ctx is done.
+func (w *Writer) Run(ctx context.Context) {
+	for {
+		changed := w.Cache.Changed()
+
+		var retry <-chan time.Time
+		if err := w.Sync(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			logrus.WithError(err).WithField("path", w.Path).Warn("unable to sync token file")
+
+			retry = time.After(retryInterval)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		case <-retry:
+		}
+	}
+}
+
+func (w *Writer) write(contents []byte) error {
+	mode := w.Mode
+	if mode == 0 {
+		mode = 0600
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(w.Path), fmt.Sprintf(".%s.*", filepath.Base(w.Path)))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if w.UID != nil || w.GID != nil {
+		uid, gid := -1, -1
+		if w.UID != nil {
+			uid = *w.UID
+		}
+		if w.GID != nil {
+			gid = *w.GID
+		}
+
+		if err := tmp.Chown(uid, gid); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), w.Path)
+}
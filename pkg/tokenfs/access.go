@@ -0,0 +1,270 @@
+package tokenfs
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/sirupsen/logrus"
+)
+
+// maxAncestry bounds the walk up the process tree.
+const maxAncestry = 64
+
+// AccessPolicy restricts which processes can read tokens, a process is allowed when it matches any of the
+// rules. The zero policy allows everyone. Processes are inspected through /proc, so rules only work on Linux.
+type AccessPolicy struct {
+	// UIDs are users whose processes are allowed.
+	UIDs []uint32
+
+	// Executables are filepath.Match patterns of the full paths of the executables that are allowed. Bare names
+	// are resolved through PATH when mounting, anything else has to be absolute.
+	Executables []string
+
+	// Ancestors are patterns like Executables of executables whose descendants are allowed, a shell for
+	// example.
+	Ancestors []string
+
+	// PIDs are processes that, along with all their descendants, are allowed.
+	PIDs []uint32
+}
+
+// Enabled reports whether the policy restricts access at all.
+func (p *AccessPolicy) Enabled() bool {
+	return len(p.UIDs) > 0 || len(p.Executables) > 0 || len(p.Ancestors) > 0 || len(p.PIDs) > 0
+}
+
+// resolve replaces the bare names of the executables and ancestors by their full paths, so that a binary of the
+// same name elsewhere, like one dropped into /tmp, doesn't match.
+func (p *AccessPolicy) resolve() error {
+	var err error
+
+	if p.Executables, err = resolveExecutables(p.Executables); err != nil {
+		return err
+	}
+	if p.Ancestors, err = resolveExecutables(p.Ancestors); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// hasMeta reports whether pattern is a glob rather than a plain path.
+func hasMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[\`)
+}
+
+func resolveExecutables(patterns []string) ([]string, error) {
+	var resolved []string
+
+	for _, pattern := range patterns {
+		if !strings.Contains(pattern, "/") {
+			if hasMeta(pattern) {
+				return nil, fmt.Errorf("executable pattern %q must be an absolute path", pattern)
+			}
+
+			path, err := exec.LookPath(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("executable %q not found in PATH, use its absolute path: %w", pattern, err)
+			}
+
+			pattern, err = filepath.Abs(path)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if !filepath.IsAbs(pattern) {
+			return nil, fmt.Errorf("executable pattern %q must be an absolute path", pattern)
+		}
+
+		// /proc/<pid>/exe has the symlinks resolved, e.g. /usr/bin/python3 runs as /usr/bin/python3.11
+		if !hasMeta(pattern) {
+			if path, err := filepath.EvalSymlinks(pattern); err == nil {
+				if path != pattern {
+					logrus.Infof("allowing %s as %s", pattern, path)
+				}
+				pattern = path
+			}
+		}
+
+		resolved = append(resolved, pattern)
+	}
+
+	return resolved, nil
+}
+
+// process is what is known about the process behind a fuse op.
+type process struct {
+	pid  uint32
+	ppid uint32
+	uid  uint32
+	exe  string
+}
+
+// readProcess inspects pid through /proc. The executable is left empty when it can't be read, which
+// happens for processes of other users.
+func readProcess(pid uint32) (*process, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := &process{
+		pid: pid,
+	}
+
+	var seenUID bool
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch key {
+		case "PPid":
+			ppid, err := strconv.ParseUint(fields[0], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse ppid of %d: %w", pid, err)
+			}
+			p.ppid = uint32(ppid)
+		case "Uid":
+			// real, effective, saved and filesystem uid, permission checks use the effective one
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("unable to parse uid of %d", pid)
+			}
+			uid, err := strconv.ParseUint(fields[1], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse uid of %d: %w", pid, err)
+			}
+			p.uid = uint32(uid)
+			seenUID = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if !seenUID {
+		return nil, fmt.Errorf("no uid in status of %d", pid)
+	}
+
+	p.exe, _ = os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+
+	return p, nil
+}
+
+func matchAny(patterns []string, exe string) bool {
+	if exe == "" {
+		return false
+	}
+
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, exe); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsPID(pids []uint32, pid uint32) bool {
+	for _, p := range pids {
+		if p == pid {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allows reports whether the policy lets p read tokens, walking up its ancestry when needed.
+func (p *AccessPolicy) allows(proc *process) bool {
+	if containsPID(p.PIDs, proc.pid) || matchAny(p.Executables, proc.exe) {
+		return true
+	}
+
+	for _, uid := range p.UIDs {
+		if uid == proc.uid {
+			return true
+		}
+	}
+
+	if len(p.Ancestors) == 0 && len(p.PIDs) == 0 {
+		return false
+	}
+
+	for i, ppid := 0, proc.ppid; i < maxAncestry && ppid > 1; i++ {
+		if containsPID(p.PIDs, ppid) {
+			return true
+		}
+
+		parent, err := readProcess(ppid)
+		if err != nil {
+			return false
+		}
+
+		if matchAny(p.Ancestors, parent.exe) {
+			return true
+		}
+
+		ppid = parent.ppid
+	}
+
+	return false
+}
+
+// authorize denies processes the access policy doesn't allow to read tokens with EACCES. Files that don't
+// contain a token are always readable. The process is returned when it had to be inspected, for auditing.
+func (fs *TokenFS) authorize(op fuseops.OpContext, n fileNode) (*process, error) {
+	if !n.secret() {
+		return nil, nil
+	}
+
+	return fs.authorizeProcess(op, n)
+}
+
+// authorizeWrite is authorize for writes, which control the mount, so they are held to the access policy no
+// matter what the file contains.
+func (fs *TokenFS) authorizeWrite(op fuseops.OpContext, n writableNode) (*process, error) {
+	return fs.authorizeProcess(op, n)
+}
+
+func (fs *TokenFS) authorizeProcess(op fuseops.OpContext, n fileNode) (*process, error) {
+	if !fs.config.Access.Enabled() && fs.config.Audit == nil {
+		return nil, nil
+	}
+
+	log := logrus.WithField("pid", op.Pid).WithField("file", n.name())
+
+	proc, err := readProcess(op.Pid)
+	if err != nil {
+		if !fs.config.Access.Enabled() {
+			return nil, nil
+		}
+
+		log.WithError(err).Warn("denied access, unable to inspect process")
+		return nil, syscall.EACCES
+	}
+
+	if fs.config.Access.Enabled() && !fs.config.Access.allows(proc) {
+		log.WithField("uid", proc.uid).WithField("exe", proc.exe).Warn("denied access")
+		return proc, syscall.EACCES
+	}
+
+	return proc, nil
+}
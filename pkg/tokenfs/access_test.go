@@ -0,0 +1,149 @@
+package tokenfs
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestAccessPolicyAllows(t *testing.T) {
+	parent, err := readProcess(uint32(os.Getppid()))
+	if err != nil {
+		t.Skipf("unable to inspect the parent process: %v", err)
+	}
+
+	// a process started by the parent of the test, so that the walk up the process tree sees real processes
+	child := &process{pid: 1 << 30, ppid: parent.pid, uid: 1000, exe: "/usr/bin/cat"}
+	orphan := &process{pid: 1 << 30, ppid: 1, uid: 1000, exe: "/usr/bin/cat"}
+
+	tests := []struct {
+		name   string
+		policy AccessPolicy
+		proc   *process
+		want   bool
+	}{
+		{
+			name:   "uid",
+			policy: AccessPolicy{UIDs: []uint32{0, 1000}},
+			proc:   orphan,
+			want:   true,
+		},
+		{
+			name:   "other uid",
+			policy: AccessPolicy{UIDs: []uint32{0}},
+			proc:   orphan,
+		},
+		{
+			name:   "executable",
+			policy: AccessPolicy{Executables: []string{"/usr/bin/cat"}},
+			proc:   orphan,
+			want:   true,
+		},
+		{
+			name:   "executable glob",
+			policy: AccessPolicy{Executables: []string{"/usr/bin/c*"}},
+			proc:   orphan,
+			want:   true,
+		},
+		{
+			name:   "executable elsewhere",
+			policy: AccessPolicy{Executables: []string{"/usr/bin/cat"}},
+			proc:   &process{pid: 1 << 30, ppid: 1, exe: "/tmp/cat"},
+		},
+		{
+			name:   "bare name",
+			policy: AccessPolicy{Executables: []string{"cat"}},
+			proc:   orphan,
+		},
+		{
+			name:   "unknown executable",
+			policy: AccessPolicy{Executables: []string{"*"}},
+			proc:   &process{pid: 1 << 30, ppid: 1},
+		},
+		{
+			name:   "pid",
+			policy: AccessPolicy{PIDs: []uint32{1 << 30}},
+			proc:   orphan,
+			want:   true,
+		},
+		{
+			name:   "descendant of pid",
+			policy: AccessPolicy{PIDs: []uint32{parent.pid}},
+			proc:   child,
+			want:   true,
+		},
+		{
+			name:   "ancestor",
+			policy: AccessPolicy{Ancestors: []string{parent.exe}},
+			proc:   child,
+			want:   true,
+		},
+		{
+			name:   "other ancestor",
+			policy: AccessPolicy{Ancestors: []string{"/nonexistent"}},
+			proc:   child,
+		},
+		{
+			name:   "ancestor of an orphan",
+			policy: AccessPolicy{Ancestors: []string{"*"}},
+			proc:   orphan,
+		},
+		{
+			name:   "ancestor isn't the process itself",
+			policy: AccessPolicy{Ancestors: []string{"/usr/bin/cat"}},
+			proc:   child,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.allows(tt.proc); got != tt.want {
+				t.Errorf("allows() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveExecutables(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh not found in PATH")
+	}
+	if sh, err = filepath.EvalSymlinks(sh); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		patterns []string
+		want     []string
+		wantErr  bool
+	}{
+		{name: "none"},
+		{name: "bare name", patterns: []string{"sh"}, want: []string{sh}},
+		{name: "absolute path", patterns: []string{sh}, want: []string{sh}},
+		{name: "absolute glob", patterns: []string{"/usr/*/aws"}, want: []string{"/usr/*/aws"}},
+		{name: "missing absolute path", patterns: []string{"/nonexistent/aws"}, want: []string{"/nonexistent/aws"}},
+		{name: "bare glob", patterns: []string{"a*"}, wantErr: true},
+		{name: "relative path", patterns: []string{"bin/aws"}, wantErr: true},
+		{name: "not in PATH", patterns: []string{"satokens-nonexistent"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveExecutables(tt.patterns)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveExecutables() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("resolveExecutables() = %q, want %q", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("resolveExecutables() = %q, want %q", got, tt.want)
+				}
+			}
+		})
+	}
+}
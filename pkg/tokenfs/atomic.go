@@ -0,0 +1,254 @@
+package tokenfs
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// dataDir is the symlink kubelet swaps to publish a new set of files.
+const dataDir = "..data"
+
+// generation is one published, immutable set of files of the atomic layout.
+type generation struct {
+	name      string
+	published time.Time
+	id        fuseops.InodeID
+	children  []child
+	contents  map[string][]byte
+	mtimes    map[string]time.Time
+	public    map[string]bool
+	paths     []string // inodes owned by the generation, forgotten when it is retired
+}
+
+func (g *generation) matches(names []string, contents map[string][]byte) bool {
+	if len(names) != len(g.children) {
+		return false
+	}
+
+	for i, name := range names {
+		if g.children[i].name != name || !bytes.Equal(g.contents[name], contents[name]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// atomicChildren lists the root of the atomic layout: the current generation, ..data pointing at it and a
+// symlink through ..data for every file.
+func (fs *TokenFS) atomicChildren(ctx context.Context) ([]child, error) {
+	gen, volatile, err := fs.generation(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	children := []child{
+		{
+			name: gen.name,
+			id:   gen.id,
+		},
+		{
+			name: dataDir,
+			id: fs.inode("/"+dataDir, func() node {
+				return &dataSymlink{fs: fs}
+			}),
+		},
+	}
+
+	for _, c := range gen.children {
+		name := c.name
+		children = append(children, child{
+			name: name,
+			id: fs.inode("/"+name, func() node {
+				return &symlink{fs: fs, to: dataDir + "/" + name, mtime: gen.published}
+			}),
+		})
+	}
+
+	// Files that change on their own would be stale in a generation, they are served live next to it.
+	for _, f := range volatile {
+		f := f
+		children = append(children, child{
+			name: f.name,
+			id: fs.inode("/"+f.name, func() node {
+				return &liveFile{fs: fs, file: f}
+			}),
+		})
+	}
+
+	return children, nil
+}
+
+// generation returns the current generation, publishing a new one when any of the files has changed since.
+// The volatile files, which aren't part of any generation, are returned alongside.
+func (fs *TokenFS) generation(ctx context.Context) (*generation, []file, error) {
+	all, err := fs.files(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var files, volatile []file
+	for _, f := range all {
+		if f.volatile {
+			volatile = append(volatile, f)
+		} else {
+			files = append(files, f)
+		}
+	}
+
+	names := make([]string, 0, len(files))
+	contents := make(map[string][]byte, len(files))
+	mtimes := make(map[string]time.Time, len(files))
+	public := make(map[string]bool, len(files))
+	for _, f := range files {
+		token, err := fs.token(ctx, f.cache)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		names = append(names, f.name)
+		contents[f.name] = f.contents(token)
+		mtimes[f.name] = fs.modified(f.cache, token)
+		public[f.name] = f.public
+	}
+
+	fs.mu.Lock()
+	current := fs.current
+	fs.mu.Unlock()
+
+	if current != nil && current.matches(names, contents) {
+		return current, volatile, nil
+	}
+
+	// same naming as the temporary directories of kubelet's AtomicWriter
+	now := time.Now()
+	gen := &generation{
+		name:      now.UTC().Format("..2006_01_02_15_04_05.000000000"),
+		published: now,
+		contents:  contents,
+		mtimes:    mtimes,
+		public:    public,
+	}
+
+	dirPath := "/" + gen.name
+	gen.id = fs.inode(dirPath, func() node {
+		return &generationDir{fs: fs, gen: gen}
+	})
+	gen.paths = append(gen.paths, dirPath)
+
+	for _, name := range names {
+		data, mtime, public := contents[name], mtimes[name], public[name]
+		path := dirPath + "/" + name
+
+		gen.children = append(gen.children, child{
+			name: name,
+			id: fs.inode(path, func() node {
+				return &snapshotFile{fs: fs, file: name, contents: data, mtime: mtime, public: public}
+			}),
+		})
+		gen.paths = append(gen.paths, path)
+	}
+
+	fs.mu.Lock()
+	if fs.current != current {
+		// lost a race with another publisher, theirs is just as new
+		published := fs.current
+		fs.mu.Unlock()
+
+		fs.forget(gen.paths...)
+		return published, volatile, nil
+	}
+
+	retired := fs.previous
+	fs.previous = current
+	fs.current = gen
+	fs.mu.Unlock()
+
+	if retired != nil {
+		fs.forget(retired.paths...)
+	}
+
+	// not while the op that published gen holds the root locked
+	if current != nil {
+		go fs.invalidateEntry(fuseops.RootInodeID, current.name)
+	}
+
+	return gen, volatile, nil
+}
+
+// published returns when the current generation was published, the zero time before the first one.
+func (fs *TokenFS) published() time.Time {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.current == nil {
+		return time.Time{}
+	}
+
+	return fs.current.published
+}
+
+// dataSymlink is ..data, it always points at the current generation.
+type dataSymlink struct {
+	fs *TokenFS
+}
+
+func (n *dataSymlink) attributes(ctx context.Context) (fuseops.InodeAttributes, error) {
+	target, err := n.target(ctx)
+	if err != nil {
+		return fuseops.InodeAttributes{}, err
+	}
+
+	return n.fs.symlinkAttributes(target, n.fs.published()), nil
+}
+
+func (n *dataSymlink) target(ctx context.Context) (string, error) {
+	gen, _, err := n.fs.generation(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return gen.name, nil
+}
+
+// generationDir is the timestamped directory holding the files of a generation.
+type generationDir struct {
+	fs  *TokenFS
+	gen *generation
+}
+
+func (d *generationDir) attributes(ctx context.Context) (fuseops.InodeAttributes, error) {
+	return d.fs.dirAttributes(d.gen.published), nil
+}
+
+func (d *generationDir) children(ctx context.Context) ([]child, error) {
+	return d.gen.children, nil
+}
+
+// snapshotFile holds the contents of a file as of its generation.
+type snapshotFile struct {
+	fs       *TokenFS
+	file     string
+	contents []byte
+	mtime    time.Time
+	public   bool
+}
+
+func (n *snapshotFile) attributes(ctx context.Context) (fuseops.InodeAttributes, error) {
+	return n.fs.fileAttributes(len(n.contents), n.mtime, n.public), nil
+}
+
+func (n *snapshotFile) name() string {
+	return n.file
+}
+
+func (n *snapshotFile) secret() bool {
+	return !n.public
+}
+
+func (n *snapshotFile) read(ctx context.Context) ([]byte, error) {
+	return n.contents, nil
+}
@@ -0,0 +1,165 @@
+package tokenfs
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+
+	"github.com/ekristen/satokens/pkg/tokensource"
+)
+
+func TestAtomicLayout(t *testing.T) {
+	source := &testSource{token: testToken("first", time.Now())}
+	fs := newTestFS(t, source, Config{Layout: LayoutAtomic})
+
+	names, err := readDir(fs, "/", 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gen, err := readLink(fs, dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(gen, "..") || gen == dataDir {
+		t.Fatalf("%s points at %q, want a timestamped directory", dataDir, gen)
+	}
+
+	want := map[string]bool{gen: true, dataDir: true, "token": true, "ca.crt": true, "namespace": true, "ttl_seconds": true, controlName: true}
+	for _, name := range names {
+		delete(want, name)
+	}
+	if len(want) != 0 {
+		t.Errorf("root lists %q, missing %v", names, want)
+	}
+
+	tests := []struct {
+		name   string
+		target string
+	}{
+		{name: "token", target: dataDir + "/token"},
+		{name: "ca.crt", target: dataDir + "/ca.crt"},
+		{name: "namespace", target: dataDir + "/namespace"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, err := readLink(fs, tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if target != tt.target {
+				t.Errorf("%s points at %q, want %q", tt.name, target, tt.target)
+			}
+		})
+	}
+
+	// volatile files are served live next to the generation, it would be stale otherwise
+	if _, err := readLink(fs, "ttl_seconds"); err == nil {
+		t.Error("ttl_seconds is a symlink, want a file")
+	}
+	if _, err := readFile(fs, "ttl_seconds"); err != nil {
+		t.Errorf("reading ttl_seconds: %v", err)
+	}
+}
+
+func TestAtomicGenerations(t *testing.T) {
+	first := testToken("first", time.Now())
+	second := testToken("second", time.Now())
+	third := testToken("third", time.Now())
+
+	source := &testSource{token: first}
+	fs := newTestFS(t, source, Config{Layout: LayoutAtomic})
+
+	rotate := func(token *tokensource.Token) {
+		t.Helper()
+
+		source.set(token)
+		if _, err := fs.cache.Refresh(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	published := func() string {
+		t.Helper()
+
+		gen, err := readLink(fs, dataDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return gen
+	}
+
+	lookUpToken := func(gen string) fuseops.InodeID {
+		t.Helper()
+
+		id, err := lookUpPath(fs, gen+"/token")
+		if err != nil {
+			t.Fatalf("looking up %s/token: %v", gen, err)
+		}
+
+		return id
+	}
+
+	readToken := func(id fuseops.InodeID) string {
+		t.Helper()
+
+		contents, err := readInode(fs, id)
+		if err != nil {
+			t.Fatalf("reading inode %d: %v", id, err)
+		}
+
+		return string(contents)
+	}
+
+	firstGen := published()
+	firstToken := lookUpToken(firstGen)
+	if got := readToken(firstToken); got != string(first.Contents) {
+		t.Errorf("%s/token = %q, want the first token", firstGen, got)
+	}
+
+	// nothing changed, nothing is published
+	if gen := published(); gen != firstGen {
+		t.Errorf("%s moved to %q without a rotation", dataDir, gen)
+	}
+
+	rotate(second)
+
+	secondGen := published()
+	if secondGen == firstGen {
+		t.Fatalf("%s still points at %q after a rotation", dataDir, firstGen)
+	}
+	secondToken := lookUpToken(secondGen)
+	if got := readToken(secondToken); got != string(second.Contents) {
+		t.Errorf("%s/token = %q, want the second token", secondGen, got)
+	}
+
+	// the previous generation is no longer listed, but files opened through it keep their contents
+	if _, err := lookUpPath(fs, firstGen); !errors.Is(err, fuse.ENOENT) {
+		t.Errorf("looking up %s after a rotation: %v, want ENOENT", firstGen, err)
+	}
+	if got := readToken(firstToken); got != string(first.Contents) {
+		t.Errorf("%s/token = %q after a rotation, want the first token", firstGen, got)
+	}
+
+	rotate(third)
+
+	thirdGen := published()
+	if got := readToken(lookUpToken(thirdGen)); got != string(third.Contents) {
+		t.Errorf("%s/token = %q, want the third token", thirdGen, got)
+	}
+	if got := readToken(secondToken); got != string(second.Contents) {
+		t.Errorf("%s/token = %q after a rotation, want the second token", secondGen, got)
+	}
+
+	// only the last two generations are kept
+	if _, err := readInode(fs, firstToken); !errors.Is(err, fuse.ENOENT) {
+		t.Errorf("reading %s/token after two rotations: %v, want ENOENT", firstGen, err)
+	}
+}
@@ -0,0 +1,158 @@
+package tokenfs
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ekristen/satokens/pkg/tokensource"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/sirupsen/logrus"
+)
+
+// Audit events.
+const (
+	AuditOpen  = "open"
+	AuditRead  = "read"
+	AuditWrite = "write" // a command was written to .control
+	AuditToken = "token" // a token that wasn't seen before was fetched
+)
+
+// AuditRecord is a single line of the audit log. The token itself is never logged, only its claims.
+type AuditRecord struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+	File  string    `json:"file"`
+
+	// PID, UID and Exe identify the process behind an open or read, UID and Exe are only known on Linux.
+	PID    uint32  `json:"pid,omitempty"`
+	UID    *uint32 `json:"uid,omitempty"`
+	Exe    string  `json:"exe,omitempty"`
+	Denied bool    `json:"denied,omitempty"`
+
+	// Command is what was written by a write.
+	Command string `json:"command,omitempty"`
+
+	JTI      string     `json:"jti,omitempty"`
+	Subject  string     `json:"sub,omitempty"`
+	IssuedAt *time.Time `json:"iat,omitempty"`
+	Expiry   *time.Time `json:"exp,omitempty"`
+}
+
+// AuditLog writes AuditRecords as JSON lines.
+type AuditLog struct {
+	mu  sync.Mutex
+	enc *json.Encoder // GUARDED_BY(mu)
+}
+
+func NewAuditLog(w io.Writer) *AuditLog {
+	return &AuditLog{
+		enc: json.NewEncoder(w),
+	}
+}
+
+// Record writes record to the log, failures are logged but never fail the op being audited.
+func (a *AuditLog) Record(record AuditRecord) {
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.enc.Encode(record); err != nil {
+		logrus.WithError(err).Error("unable to write audit record")
+	}
+}
+
+// withClaims fills in the claims of the token in contents, if it can be decoded.
+func (r AuditRecord) withClaims(contents []byte) AuditRecord {
+	claims, err := tokensource.ParseClaims(contents)
+	if err != nil {
+		return r
+	}
+
+	r.JTI = claims.ID
+	r.Subject = claims.Subject
+	if iat := claims.IssuedAtTime(); !iat.IsZero() {
+		r.IssuedAt = &iat
+	}
+	if exp := claims.ExpiresAt(); !exp.IsZero() {
+		r.Expiry = &exp
+	}
+
+	return r
+}
+
+// audit records an open or read of the token n at inode id by the process behind op, proc is nil when it wasn't
+// inspected.
+func (fs *TokenFS) audit(event string, op fuseops.OpContext, id fuseops.InodeID, n fileNode, proc *process, denied bool, contents []byte) {
+	if fs.config.Audit == nil || !n.secret() {
+		return
+	}
+
+	fs.record(AuditRecord{
+		Event:  event,
+		PID:    op.Pid,
+		Denied: denied,
+	}.withClaims(contents), id, n, proc)
+}
+
+// auditWrite records an open for writing or a write of data to n at inode id, like audit does for tokens.
+func (fs *TokenFS) auditWrite(event string, op fuseops.OpContext, id fuseops.InodeID, n writableNode, proc *process, denied bool, data []byte) {
+	if fs.config.Audit == nil {
+		return
+	}
+
+	fs.record(AuditRecord{
+		Event:   event,
+		PID:     op.Pid,
+		Denied:  denied,
+		Command: strings.Join(strings.Fields(string(data)), " "),
+	}, id, n, proc)
+}
+
+// record fills in the file and process of record and writes it to the audit log.
+func (fs *TokenFS) record(record AuditRecord, id fuseops.InodeID, n fileNode, proc *process) {
+	// the path relative to the mount tells the tokens apart, they are all called token
+	fs.mu.Lock()
+	path := strings.TrimPrefix(fs.paths[id], "/")
+	fs.mu.Unlock()
+
+	if path == "" {
+		path = n.name()
+	}
+	record.File = path
+
+	if proc != nil {
+		uid := proc.uid
+		record.UID = &uid
+		record.Exe = proc.exe
+	}
+
+	fs.config.Audit.Record(record)
+}
+
+// auditTokens records every distinct token cache holds until ctx is done, building a history of the tokens
+// issued during the lifetime of the mount.
+func (fs *TokenFS) auditTokens(ctx context.Context, name string, cache *tokensource.Cache) {
+	for {
+		changed := cache.Changed()
+
+		if token := cache.Cached(); token != nil {
+			fs.config.Audit.Record(AuditRecord{
+				Event: AuditToken,
+				File:  name,
+			}.withClaims(token.Contents))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package tokenfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// auditBuffer collects the lines of an audit log.
+type auditBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *auditBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *auditBuffer) records(t *testing.T) []AuditRecord {
+	t.Helper()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var records []AuditRecord
+	scanner := bufio.NewScanner(bytes.NewReader(b.buf.Bytes()))
+	for scanner.Scan() {
+		var record AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("invalid audit record %q: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+
+	return records
+}
+
+func TestAudit(t *testing.T) {
+	exe, _ := os.Readlink("/proc/self/exe")
+
+	tests := []struct {
+		name       string
+		path       string
+		access     AccessPolicy
+		wantErr    error
+		wantEvents []string
+	}{
+		{
+			name:       "token",
+			path:       "token",
+			wantEvents: []string{AuditOpen, AuditRead},
+		},
+		{
+			name:       "denied",
+			path:       "token",
+			access:     AccessPolicy{UIDs: []uint32{uint32(os.Getuid()) + 1}},
+			wantErr:    syscall.EACCES,
+			wantEvents: []string{AuditOpen},
+		},
+		{
+			name: "public file",
+			path: "ca.crt",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := testToken("first", time.Now())
+
+			var log auditBuffer
+			fs := newTestFS(t, &testSource{token: token}, Config{Access: tt.access, Audit: NewAuditLog(&log)})
+
+			// the token is recorded once it is issued, whether or not it is read
+			waitFor(t, func() bool { return len(log.records(t)) > 0 })
+
+			if _, err := readFile(fs, tt.path); !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+				t.Fatalf("reading %s: %v, want %v", tt.path, err, tt.wantErr)
+			}
+
+			records := log.records(t)
+
+			issued := records[0]
+			if issued.Event != AuditToken || issued.File != "token" || issued.JTI != "first" || issued.PID != 0 {
+				t.Errorf("first record = %+v, want the issued token", issued)
+			}
+
+			var events []string
+			for _, record := range records[1:] {
+				events = append(events, record.Event)
+
+				if record.File != tt.path || record.PID != testOp.Pid || record.Denied != (tt.wantErr != nil) {
+					t.Errorf("record = %+v, want an access to %s by this process", record, tt.path)
+				}
+				if exe != "" && record.Exe != exe {
+					t.Errorf("record of %s, want %s", record.Exe, exe)
+				}
+				if record.UID == nil || *record.UID != uint32(os.Getuid()) {
+					t.Errorf("record of uid %v, want %d", record.UID, os.Getuid())
+				}
+
+				// denied reads don't get to see the token
+				wantJTI := "first"
+				if record.Denied {
+					wantJTI = ""
+				}
+				if record.JTI != wantJTI || (wantJTI != "" && (record.Subject == "" || record.Expiry == nil)) {
+					t.Errorf("record = %+v, want the claims of the token %q", record, wantJTI)
+				}
+			}
+
+			if len(events) != len(tt.wantEvents) {
+				t.Fatalf("audited %q, want %q", events, tt.wantEvents)
+			}
+			for i := range events {
+				if events[i] != tt.wantEvents[i] {
+					t.Errorf("audited %q, want %q", events, tt.wantEvents)
+				}
+			}
+		})
+	}
+}
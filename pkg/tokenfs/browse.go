@@ -0,0 +1,302 @@
+package tokenfs
+
+import (
+	"context"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	"github.com/ekristen/satokens/pkg/tokensource"
+)
+
+// listingTTL keeps every lookup from listing namespaces or service accounts through the API again.
+const listingTTL = 10 * time.Second
+
+// Browser lists the namespaces and service accounts LayoutBrowse presents and provides their tokens.
+type Browser interface {
+	Namespaces(ctx context.Context) ([]string, error)
+	ServiceAccounts(ctx context.Context, namespace string) ([]string, error)
+	Source(namespace, name string) tokensource.TokenSource
+}
+
+type listing struct {
+	names []string
+	err   error
+	at    time.Time
+}
+
+type serviceAccount struct {
+	namespace string
+	name      string
+}
+
+func (sa serviceAccount) String() string {
+	return sa.namespace + "/" + sa.name
+}
+
+// list returns the service accounts in namespace, or the namespaces when it is empty.
+func (fs *TokenFS) list(ctx context.Context, namespace string) ([]string, error) {
+	fs.mu.Lock()
+	l := fs.listings[namespace]
+	fs.mu.Unlock()
+
+	if l != nil && time.Since(l.at) < listingTTL {
+		return l.names, l.err
+	}
+
+	var names []string
+	var err error
+	if namespace == "" {
+		names, err = fs.config.Browser.Namespaces(ctx)
+	} else {
+		names, err = fs.config.Browser.ServiceAccounts(ctx, namespace)
+	}
+
+	if err != nil && ctx.Err() != nil {
+		return nil, syscall.EINTR
+	}
+
+	fs.mu.Lock()
+	fs.listings[namespace] = &listing{
+		names: names,
+		err:   err,
+		at:    time.Now(),
+	}
+	fs.mu.Unlock()
+
+	return names, err
+}
+
+// exists reports whether name is in the listing of namespace. When the listing fails, for lack of
+// permissions for example, every valid name is assumed to exist so it can still be opened by path.
+func (fs *TokenFS) exists(ctx context.Context, namespace, name string) (bool, error) {
+	names, err := fs.list(ctx, namespace)
+	if err == syscall.EINTR {
+		return false, err
+	}
+	if err != nil {
+		return true, nil
+	}
+
+	for _, n := range names {
+		if n == name {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// browsedCache returns the cache of the tokens of sa, setting it up on first use and again after it was evicted.
+func (fs *TokenFS) browsedCache(sa serviceAccount) *tokensource.Cache {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	d, ok := fs.browsed[sa]
+	if !ok {
+		d = fs.newDemandCache(sa.String()+"/token", fs.config.Browser.Source(sa.namespace, sa.name))
+		fs.browsed[sa] = d
+	}
+	d.used = time.Now()
+
+	return d.cache
+}
+
+// browsedCacheInUse returns the cache of the tokens of sa without setting one up, nil if there is none.
+func (fs *TokenFS) browsedCacheInUse(sa serviceAccount) *tokensource.Cache {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if d, ok := fs.browsed[sa]; ok {
+		return d.cache
+	}
+
+	return nil
+}
+
+func (fs *TokenFS) namespaceInode(namespace string) fuseops.InodeID {
+	return fs.inode("/"+namespace, func() node {
+		return &namespaceDir{fs: fs, namespace: namespace}
+	})
+}
+
+// namespaceChildren lists the root of the browse layout.
+func (fs *TokenFS) namespaceChildren(ctx context.Context) ([]child, error) {
+	namespaces, err := fs.list(ctx, "")
+	if err != nil {
+		if err == syscall.EINTR {
+			return nil, err
+		}
+
+		logrus.WithError(err).Warn("unable to list namespaces")
+		return nil, fuse.EIO
+	}
+
+	var children []child
+	for _, namespace := range namespaces {
+		children = append(children, child{
+			name: namespace,
+			id:   fs.namespaceInode(namespace),
+		})
+	}
+
+	return children, nil
+}
+
+func (fs *TokenFS) lookUpNamespace(ctx context.Context, name string) (fuseops.InodeID, error) {
+	if len(validation.IsDNS1123Label(name)) > 0 {
+		return 0, fuse.ENOENT
+	}
+
+	ok, err := fs.exists(ctx, "", name)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, fuse.ENOENT
+	}
+
+	return fs.namespaceInode(name), nil
+}
+
+// namespaceDir lists the service accounts of a namespace.
+type namespaceDir struct {
+	fs        *TokenFS
+	namespace string
+}
+
+func (d *namespaceDir) evictable() {}
+
+func (d *namespaceDir) attributes(ctx context.Context) (fuseops.InodeAttributes, error) {
+	return d.fs.dirAttributes(time.Time{}), nil
+}
+
+func (d *namespaceDir) serviceAccountInode(name string) fuseops.InodeID {
+	sa := serviceAccount{
+		namespace: d.namespace,
+		name:      name,
+	}
+
+	return d.fs.inode("/"+sa.String(), func() node {
+		return &serviceAccountDir{fs: d.fs, sa: sa}
+	})
+}
+
+func (d *namespaceDir) children(ctx context.Context) ([]child, error) {
+	names, err := d.fs.list(ctx, d.namespace)
+	if err != nil {
+		if err == syscall.EINTR {
+			return nil, err
+		}
+
+		logrus.WithError(err).Warnf("unable to list service accounts in %s", d.namespace)
+		return nil, fuse.EIO
+	}
+
+	var children []child
+	for _, name := range names {
+		children = append(children, child{
+			name: name,
+			id:   d.serviceAccountInode(name),
+		})
+	}
+
+	return children, nil
+}
+
+func (d *namespaceDir) lookUp(ctx context.Context, name string) (fuseops.InodeID, error) {
+	if len(validation.IsDNS1123Subdomain(name)) > 0 {
+		return 0, fuse.ENOENT
+	}
+
+	ok, err := d.fs.exists(ctx, d.namespace, name)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, fuse.ENOENT
+	}
+
+	return d.serviceAccountInode(name), nil
+}
+
+// serviceAccountDir holds the serviceaccount directory of one service account. Its token is minted when one of
+// its files is read, and evicted once they haven't been for idleCacheTTL.
+type serviceAccountDir struct {
+	fs *TokenFS
+	sa serviceAccount
+}
+
+func (d *serviceAccountDir) evictable() {}
+
+func (d *serviceAccountDir) attributes(ctx context.Context) (fuseops.InodeAttributes, error) {
+	// Don't mint a token for every service account a listing stats, only report on the ones in use.
+	var mtime time.Time
+	if cache := d.fs.browsedCacheInUse(d.sa); cache != nil {
+		mtime = d.fs.modified(cache, nil)
+	}
+
+	return d.fs.dirAttributes(mtime), nil
+}
+
+func (d *serviceAccountDir) fileInode(f file) fuseops.InodeID {
+	return d.fs.inode("/"+d.sa.String()+"/"+f.name, func() node {
+		return &demandFile{
+			fs:   d.fs,
+			file: f,
+			cache: func() *tokensource.Cache {
+				return d.fs.browsedCache(d.sa)
+			},
+			cached: func() *tokensource.Cache {
+				return d.fs.browsedCacheInUse(d.sa)
+			},
+		}
+	})
+}
+
+// files returns the files of the service account without minting. Optional files are only left out once a token
+// is cached that doesn't have them, until then every name is listed and one the token turns out not to have
+// reads as empty.
+func (d *serviceAccountDir) files() []file {
+	var token *tokensource.Token
+	if cache := d.fs.browsedCacheInUse(d.sa); cache != nil {
+		token = cache.Cached()
+	}
+
+	var files []file
+	for _, f := range staticFiles {
+		if token != nil && f.optional && len(f.contents(token)) == 0 {
+			continue
+		}
+		files = append(files, f)
+	}
+
+	return files
+}
+
+func (d *serviceAccountDir) children(ctx context.Context) ([]child, error) {
+	var children []child
+	for _, f := range d.files() {
+		children = append(children, child{
+			name: f.name,
+			id:   d.fileInode(f),
+		})
+	}
+
+	return children, nil
+}
+
+// lookUp only resolves the names of the files, anything else a shell or an editor probes for doesn't exist.
+func (d *serviceAccountDir) lookUp(ctx context.Context, name string) (fuseops.InodeID, error) {
+	for _, f := range d.files() {
+		if f.name == name {
+			return d.fileInode(f), nil
+		}
+	}
+
+	return 0, fuse.ENOENT
+}
@@ -0,0 +1,127 @@
+package tokenfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+
+	"github.com/ekristen/satokens/pkg/tokensource"
+)
+
+// testBrowser lists fixed namespaces and service accounts, serving the same token for all of them.
+type testBrowser struct {
+	namespaces      []string
+	serviceAccounts map[string][]string
+	source          *testSource
+}
+
+func (b *testBrowser) Namespaces(ctx context.Context) ([]string, error) {
+	return b.namespaces, nil
+}
+
+func (b *testBrowser) ServiceAccounts(ctx context.Context, namespace string) ([]string, error) {
+	return b.serviceAccounts[namespace], nil
+}
+
+func (b *testBrowser) Source(namespace, name string) tokensource.TokenSource {
+	return b.source
+}
+
+func TestBrowseListing(t *testing.T) {
+	browser := &testBrowser{source: &testSource{token: testToken("first", time.Now())}}
+	for i := 0; i < 300; i++ {
+		browser.namespaces = append(browser.namespaces, fmt.Sprintf("namespace-%03d", i))
+	}
+
+	fs := newTestFS(t, nil, Config{Layout: LayoutBrowse, Browser: browser})
+
+	tests := []struct {
+		name string
+		size int
+	}{
+		{name: "one read", size: 64 * 1024},
+		// a few entries per read, the listing takes many
+		{name: "several reads", size: 256},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			names, err := readDir(fs, "/", tt.size)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the namespaces, followed by .control
+			want := append(append([]string{}, browser.namespaces...), controlName)
+			if len(names) != len(want) {
+				t.Fatalf("listed %d entries, want %d", len(names), len(want))
+			}
+			for i := range names {
+				if names[i] != want[i] {
+					t.Fatalf("entry %d = %q, want %q", i, names[i], want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestBrowseDoesNotMintOnListing(t *testing.T) {
+	// a token without a ca.crt
+	token := testToken("first", time.Now())
+	token.CACert = nil
+
+	source := &testSource{token: token}
+	fs := newTestFS(t, nil, Config{
+		Layout: LayoutBrowse,
+		Browser: &testBrowser{
+			namespaces:      []string{"default"},
+			serviceAccounts: map[string][]string{"default": {"app"}},
+			source:          source,
+		},
+	})
+
+	names, err := readDir(fs, "default/app", 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != len(staticFiles) {
+		t.Errorf("default/app = %q, want every file", names)
+	}
+
+	id, err := lookUpPath(fs, "default/app/token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.GetInodeAttributes(context.Background(), &fuseops.GetInodeAttributesOp{Inode: id, OpContext: testOp}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := lookUpPath(fs, "default/app/.git"); !errors.Is(err, fuse.ENOENT) {
+		t.Errorf("looking up default/app/.git: %v, want ENOENT", err)
+	}
+
+	if source.Calls() != 0 {
+		t.Fatalf("minted %d tokens, want none until a file is read", source.Calls())
+	}
+
+	contents, err := readFile(fs, "default/app/token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != string(token.Contents) {
+		t.Errorf("token = %q, want the token of default/app", contents)
+	}
+	if source.Calls() != 1 {
+		t.Errorf("minted %d tokens, want 1", source.Calls())
+	}
+
+	// once the token is known, the files it doesn't have are left out
+	if _, err := lookUpPath(fs, "default/app/ca.crt"); !errors.Is(err, fuse.ENOENT) {
+		t.Errorf("looking up default/app/ca.crt: %v, want ENOENT once the token is read", err)
+	}
+}
@@ -0,0 +1,206 @@
+package tokenfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ekristen/satokens/pkg/tokensource"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/sirupsen/logrus"
+)
+
+// controlName is the file commands are written to and status is read from.
+const controlName = ".control"
+
+// controlFileMode keeps commands to the owner of the mount, no matter the permissions of the tokens.
+const controlFileMode = 0600
+
+// Control commands.
+const (
+	ControlRefresh   = "refresh"   // fetch every token now
+	ControlReconnect = "reconnect" // drop and re-establish the connection to the source
+	ControlFlush     = "flush"     // forget every token, they are fetched again on the next read
+)
+
+// Connection is the connection tokens are fetched over, .control reports on it and can reset it.
+type Connection interface {
+	fmt.Stringer
+	Reconnect()
+}
+
+// controlFile reports the status of the filesystem when read and runs the commands written to it.
+type controlFile struct {
+	fs *TokenFS
+}
+
+func (n *controlFile) attributes(ctx context.Context) (fuseops.InodeAttributes, error) {
+	contents, _ := n.read(ctx)
+
+	attributes := n.fs.fileAttributes(len(contents), time.Now(), false)
+	attributes.Mode = controlFileMode
+
+	return attributes, nil
+}
+
+func (n *controlFile) name() string {
+	return controlName
+}
+
+func (n *controlFile) secret() bool {
+	return false
+}
+
+// read returns the status as key=value lines.
+func (n *controlFile) read(ctx context.Context) ([]byte, error) {
+	var buf bytes.Buffer
+
+	line := func(key, value string) {
+		if value != "" {
+			fmt.Fprintf(&buf, "%s=%s\n", key, value)
+		}
+	}
+
+	timestamp := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339)
+	}
+
+	line("source", n.fs.config.Source)
+
+	if conn := n.fs.config.Connection; conn != nil {
+		line("connection", conn.String())
+	}
+
+	for _, c := range n.fs.caches() {
+		status := c.cache.Status()
+
+		line(c.name+".last_refresh", timestamp(status.LastRefresh))
+		line(c.name+".last_change", timestamp(status.LastChange))
+		line(c.name+".expires_at", timestamp(status.ExpiresAt))
+
+		if status.LastError != nil {
+			line(c.name+".last_error", status.LastError.Error())
+			line(c.name+".last_error_at", timestamp(status.LastErrorAt))
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// write runs the commands in data, one per line.
+func (n *controlFile) write(ctx context.Context, data []byte) error {
+	for _, command := range strings.Fields(string(data)) {
+		logrus.WithField("command", command).Info("running control command")
+
+		if err := n.fs.control(ctx, command); err != nil {
+			logrus.WithError(err).WithField("command", command).Warn("control command failed")
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (fs *TokenFS) controlInode() fuseops.InodeID {
+	return fs.inode("/"+controlName, func() node {
+		return &controlFile{fs: fs}
+	})
+}
+
+type cacheEntry struct {
+	name  string
+	cache *tokensource.Cache
+}
+
+// caches returns the cache of the default token followed by the additional, minted and browsed ones.
+func (fs *TokenFS) caches() []cacheEntry {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var caches []cacheEntry
+	if fs.cache != nil {
+		caches = append(caches, cacheEntry{
+			name:  "token",
+			cache: fs.cache,
+		})
+	}
+
+	var names []string
+	for name := range fs.named {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		caches = append(caches, cacheEntry{
+			name:  name,
+			cache: fs.named[name],
+		})
+	}
+
+	var keys []mintKey
+	for key := range fs.minted {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].String() < keys[j].String()
+	})
+
+	for _, key := range keys {
+		caches = append(caches, cacheEntry{
+			name:  key.String(),
+			cache: fs.minted[key].cache,
+		})
+	}
+
+	var accounts []serviceAccount
+	for sa := range fs.browsed {
+		accounts = append(accounts, sa)
+	}
+	sort.Slice(accounts, func(i, j int) bool {
+		return accounts[i].String() < accounts[j].String()
+	})
+
+	for _, sa := range accounts {
+		caches = append(caches, cacheEntry{
+			name:  sa.String(),
+			cache: fs.browsed[sa].cache,
+		})
+	}
+
+	return caches
+}
+
+func (fs *TokenFS) control(ctx context.Context, command string) error {
+	switch command {
+	case ControlRefresh:
+		for _, c := range fs.caches() {
+			if _, err := c.cache.Refresh(ctx); err != nil {
+				if ctx.Err() != nil {
+					return syscall.EINTR
+				}
+				return syscall.EIO
+			}
+		}
+	case ControlReconnect:
+		if fs.config.Connection == nil {
+			return syscall.ENOTSUP
+		}
+		fs.config.Connection.Reconnect()
+	case ControlFlush:
+		for _, c := range fs.caches() {
+			c.cache.Flush()
+		}
+	default:
+		return syscall.EINVAL
+	}
+
+	return nil
+}
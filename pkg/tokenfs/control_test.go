@@ -0,0 +1,204 @@
+package tokenfs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// writeFile opens the file at path for writing and writes data to it like echo does.
+func writeFile(fs *TokenFS, path string, data string) error {
+	id, err := lookUpPath(fs, path)
+	if err != nil {
+		return err
+	}
+
+	if err := fs.OpenFile(context.Background(), &fuseops.OpenFileOp{Inode: id, OpenFlags: syscall.O_WRONLY, OpContext: testOp}); err != nil {
+		return err
+	}
+
+	return fs.WriteFile(context.Background(), &fuseops.WriteFileOp{Inode: id, Data: []byte(data), OpContext: testOp})
+}
+
+// testConnection counts reconnects.
+type testConnection struct {
+	mu         sync.Mutex
+	reconnects int
+}
+
+func (c *testConnection) String() string {
+	return "connected"
+}
+
+func (c *testConnection) Reconnect() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.reconnects++
+}
+
+func TestControlStatus(t *testing.T) {
+	fs := newTestFS(t, &testSource{token: testToken("first", time.Now())}, Config{
+		Source:     "server:default/satokens",
+		Connection: &testConnection{},
+	})
+
+	if _, err := readFile(fs, "token"); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := readFile(fs, controlName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"source=server:default/satokens\n", "connection=connected\n", "token.last_refresh=", "token.expires_at="} {
+		if !strings.Contains(string(status), want) {
+			t.Errorf("status %q doesn't contain %q", status, want)
+		}
+	}
+}
+
+func TestControlCommands(t *testing.T) {
+	tests := []struct {
+		name           string
+		command        string
+		connection     bool
+		wantErr        error
+		wantCalls      bool
+		wantReconnects int
+	}{
+		{name: "refresh", command: "refresh\n", wantCalls: true},
+		{name: "flush", command: "flush\n"},
+		{name: "reconnect", command: "reconnect\n", connection: true, wantReconnects: 1},
+		{name: "reconnect without a connection", command: "reconnect\n", wantErr: syscall.ENOTSUP},
+		{name: "several", command: "reconnect refresh\n", connection: true, wantCalls: true, wantReconnects: 1},
+		{name: "unknown", command: "restart\n", wantErr: syscall.EINVAL},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := &testSource{token: testToken("first", time.Now())}
+			connection := &testConnection{}
+
+			cfg := Config{}
+			if tt.connection {
+				cfg.Connection = connection
+			}
+			fs := newTestFS(t, source, cfg)
+
+			if _, err := readFile(fs, "token"); err != nil {
+				t.Fatal(err)
+			}
+			calls := source.Calls()
+
+			err := writeFile(fs, controlName, tt.command)
+			if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+				t.Fatalf("writing %q: %v, want %v", tt.command, err, tt.wantErr)
+			}
+
+			if called := source.Calls() > calls; called != tt.wantCalls {
+				t.Errorf("token fetched: %v, want %v", called, tt.wantCalls)
+			}
+			if connection.reconnects != tt.wantReconnects {
+				t.Errorf("%d reconnects, want %d", connection.reconnects, tt.wantReconnects)
+			}
+		})
+	}
+}
+
+func TestControlFlush(t *testing.T) {
+	source := &testSource{token: testToken("first", time.Now())}
+	fs := newTestFS(t, source, Config{})
+
+	if _, err := readFile(fs, "token"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeFile(fs, controlName, "flush\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the next read fetches again
+	source.set(testToken("second", time.Now()))
+
+	contents, err := readFile(fs, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := testToken("second", time.Now()).Contents; string(contents) != string(want) {
+		t.Errorf("token = %q after flush, want the second token", contents)
+	}
+}
+
+func TestControlAccess(t *testing.T) {
+	var log auditBuffer
+
+	source := &testSource{token: testToken("first", time.Now())}
+	fs := newTestFS(t, source, Config{
+		Access: AccessPolicy{UIDs: []uint32{uint32(os.Getuid()) + 1}},
+		Audit:  NewAuditLog(&log),
+	})
+
+	id, err := lookUpPath(fs, controlName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	open := &fuseops.OpenFileOp{Inode: id, OpenFlags: syscall.O_WRONLY, OpContext: testOp}
+	if err := fs.OpenFile(context.Background(), open); !errors.Is(err, syscall.EACCES) {
+		t.Errorf("opening %s for writing: %v, want %v", controlName, err, syscall.EACCES)
+	}
+
+	calls := source.Calls()
+
+	// a handle opened before the policy applied, or passed on by an allowed process
+	write := &fuseops.WriteFileOp{Inode: id, Data: []byte("refresh\n"), OpContext: testOp}
+	if err := fs.WriteFile(context.Background(), write); !errors.Is(err, syscall.EACCES) {
+		t.Errorf("writing %s: %v, want %v", controlName, err, syscall.EACCES)
+	}
+	if source.Calls() != calls {
+		t.Error("refresh ran for a denied process")
+	}
+
+	var events []string
+	for _, record := range log.records(t) {
+		if record.File != controlName {
+			continue
+		}
+
+		events = append(events, record.Event)
+		if !record.Denied || record.PID != testOp.Pid {
+			t.Errorf("record = %+v, want a denied access by this process", record)
+		}
+		if record.Event == AuditWrite && record.Command != "refresh" {
+			t.Errorf("record of command %q, want %q", record.Command, "refresh")
+		}
+	}
+
+	if strings.Join(events, ",") != AuditOpen+","+AuditWrite {
+		t.Errorf("audited %q, want an open and a write", events)
+	}
+
+	// status doesn't contain a token, reading it isn't restricted
+	if _, err := readFile(fs, controlName); err != nil {
+		t.Errorf("reading %s: %v", controlName, err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	fs := newTestFS(t, &testSource{token: testToken("first", time.Now())}, Config{})
+
+	for _, name := range []string{"token", "ca.crt"} {
+		if err := writeFile(fs, name, "x"); !errors.Is(err, syscall.EROFS) {
+			t.Errorf("writing %s: %v, want %v", name, err, syscall.EROFS)
+		}
+	}
+}
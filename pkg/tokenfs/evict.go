@@ -0,0 +1,162 @@
+package tokenfs
+
+import (
+	"context"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+
+	"github.com/ekristen/satokens/pkg/tokensource"
+)
+
+const (
+	// idleCacheTTL is how long a token minted on demand keeps being refreshed after it was last used.
+	idleCacheTTL = 10 * time.Minute
+
+	evictInterval = time.Minute
+)
+
+// demandCache is the cache of a token that is minted on demand for a path someone used. It is stopped and
+// dropped once it hasn't been used for idleCacheTTL, using the path again sets up a new one.
+type demandCache struct {
+	cache  *tokensource.Cache
+	cancel context.CancelFunc
+	used   time.Time
+}
+
+func (fs *TokenFS) newDemandCache(name string, source tokensource.TokenSource) *demandCache {
+	ctx, cancel := context.WithCancel(fs.ctx)
+
+	return &demandCache{
+		cache:  fs.startCache(ctx, name, source),
+		cancel: cancel,
+		used:   time.Now(),
+	}
+}
+
+// evict stops and drops the caches of tokens minted on demand that haven't been used for idleCacheTTL, every
+// evictInterval until ctx is done.
+func (fs *TokenFS) evict(ctx context.Context) {
+	ticker := time.NewTicker(evictInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			fs.evictIdle(now)
+		}
+	}
+}
+
+func (fs *TokenFS) evictIdle(now time.Time) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for key, d := range fs.minted {
+		if now.Sub(d.used) >= idleCacheTTL {
+			d.cancel()
+			delete(fs.minted, key)
+		}
+	}
+
+	for sa, d := range fs.browsed {
+		if now.Sub(d.used) >= idleCacheTTL {
+			d.cancel()
+			delete(fs.browsed, sa)
+		}
+	}
+}
+
+// evictable is implemented by the nodes of paths that can be looked up without bound, like the audiences of
+// the aud tree or the service accounts of the browse layout. Their inodes are dropped once the kernel forgets
+// them, every other inode is kept for the lifetime of the mount.
+type evictable interface {
+	node
+	evictable()
+}
+
+// ref counts a lookup of id by the kernel, false if the inode was dropped in the meantime.
+func (fs *TokenFS) ref(id fuseops.InodeID) bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, ok := fs.inodes[id]; !ok {
+		return false
+	}
+
+	fs.lookups[id]++
+
+	return true
+}
+
+func (fs *TokenFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if op.N < fs.lookups[op.Inode] {
+		fs.lookups[op.Inode] -= op.N
+		return nil
+	}
+
+	delete(fs.lookups, op.Inode)
+
+	if _, ok := fs.inodes[op.Inode].(evictable); !ok {
+		return nil
+	}
+
+	delete(fs.inodes, op.Inode)
+	delete(fs.ids, fs.paths[op.Inode])
+	delete(fs.paths, op.Inode)
+
+	return nil
+}
+
+// demandFile is a file of a token minted on demand. It looks its cache up on every use rather than holding on
+// to it, so that the cache can be evicted while the file stays around. cache sets the cache up when there is
+// none, cached only returns the one in use, nil if there is none.
+type demandFile struct {
+	fs     *TokenFS
+	file   file
+	cache  func() *tokensource.Cache
+	cached func() *tokensource.Cache
+}
+
+func (n *demandFile) live() *liveFile {
+	f := n.file
+	f.cache = n.cache()
+
+	return &liveFile{fs: n.fs, file: f}
+}
+
+// attributes doesn't mint, a lookup or a listing stats every file. Until the token is first read the file is
+// empty, which doesn't keep it from being read since it is opened with direct IO, and dated like the directories
+// above it.
+func (n *demandFile) attributes(ctx context.Context) (fuseops.InodeAttributes, error) {
+	size, mtime := 0, n.fs.lastModified()
+	if cache := n.cached(); cache != nil {
+		if token := cache.Cached(); token != nil {
+			size = len(n.file.contents(token))
+			mtime = n.fs.modified(cache, token)
+		}
+	}
+
+	return n.fs.fileAttributes(size, mtime, n.file.public), nil
+}
+
+func (n *demandFile) name() string {
+	return n.file.name
+}
+
+func (n *demandFile) secret() bool {
+	return !n.file.public
+}
+
+func (n *demandFile) read(ctx context.Context) ([]byte, error) {
+	return n.live().read(ctx)
+}
+
+func (n *demandFile) evictable() {}
@@ -0,0 +1,105 @@
+package tokenfs
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+
+	"github.com/ekristen/satokens/pkg/tokensource"
+)
+
+func TestMetadataFiles(t *testing.T) {
+	iat := time.Unix(time.Now().Unix(), 0)
+	token := testToken("first", iat)
+
+	fs := newTestFS(t, &testSource{token: token}, Config{})
+
+	tests := []struct {
+		name  string
+		check func(t *testing.T, contents string)
+	}{
+		{
+			name:  "token",
+			check: equals(string(token.Contents)),
+		},
+		{
+			name:  "ca.crt",
+			check: equals("ca"),
+		},
+		{
+			name:  "namespace",
+			check: equals("default"),
+		},
+		{
+			name:  "service_account",
+			check: equals("app"),
+		},
+		{
+			name:  "audience",
+			check: equals("vault"),
+		},
+		{
+			name:  "expires_at",
+			check: equals(iat.Add(time.Hour).UTC().Format(time.RFC3339)),
+		},
+		{
+			name: "ttl_seconds",
+			check: func(t *testing.T, contents string) {
+				ttl, err := strconv.Atoi(contents)
+				if err != nil || ttl <= 0 || ttl > 3600 {
+					t.Errorf("ttl_seconds = %q, want the seconds left of an hour", contents)
+				}
+			},
+		},
+		{
+			name: "claims.json",
+			check: func(t *testing.T, contents string) {
+				var claims tokensource.Claims
+				if err := json.Unmarshal([]byte(contents), &claims); err != nil {
+					t.Fatalf("claims.json isn't JSON: %v", err)
+				}
+				if claims.ID != "first" || claims.Subject != "system:serviceaccount:default:app" {
+					t.Errorf("claims.json = %s, want the claims of the token", contents)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contents, err := readFile(fs, tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tt.check(t, string(contents))
+		})
+	}
+}
+
+func TestOptionalFilesHidden(t *testing.T) {
+	// a token that can't be decoded, from a source that has no ca.crt or namespace either
+	fs := newTestFS(t, &testSource{token: tokensource.NewToken([]byte("opaque"))}, Config{})
+
+	for _, name := range []string{"ca.crt", "namespace", "claims.json", "expires_at", "ttl_seconds", "audience", "service_account"} {
+		if _, err := lookUpPath(fs, name); !errors.Is(err, fuse.ENOENT) {
+			t.Errorf("looking up %s: %v, want ENOENT", name, err)
+		}
+	}
+
+	if contents, err := readFile(fs, "token"); err != nil || string(contents) != "opaque" {
+		t.Errorf("token = %q, %v, want %q", contents, err, "opaque")
+	}
+}
+
+func equals(want string) func(t *testing.T, contents string) {
+	return func(t *testing.T, contents string) {
+		if contents != want {
+			t.Errorf("contents = %q, want %q", contents, want)
+		}
+	}
+}
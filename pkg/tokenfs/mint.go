@@ -0,0 +1,258 @@
+package tokenfs
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+
+	"github.com/ekristen/satokens/pkg/tokensource"
+)
+
+// mintDir is the root of the aud/<audience>/exp/<seconds>/token tree, where tokens are minted on lookup.
+// Audiences are path escaped, so audiences containing a slash can be used as well.
+const mintDir = "aud"
+
+type mintKey struct {
+	audience   string
+	expiration int64
+}
+
+func (k mintKey) String() string {
+	return fmt.Sprintf("%s/%s/exp/%d", mintDir, url.PathEscape(k.audience), k.expiration)
+}
+
+// minter returns the source tokens for arbitrary audiences are minted from, nil if there is none.
+func (fs *TokenFS) minter() tokensource.MintingSource {
+	return fs.config.Minter
+}
+
+// mintedCache returns the cache of tokens for key, setting it up on first use and again after it was evicted.
+func (fs *TokenFS) mintedCache(key mintKey) *tokensource.Cache {
+	minter := fs.minter()
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	d, ok := fs.minted[key]
+	if !ok {
+		d = fs.newDemandCache(key.String()+"/token", minter.Mint(key.audience, key.expiration))
+		fs.minted[key] = d
+	}
+	d.used = time.Now()
+
+	return d.cache
+}
+
+// mintedCacheInUse returns the cache of tokens for key without setting one up, nil if there is none.
+func (fs *TokenFS) mintedCacheInUse(key mintKey) *tokensource.Cache {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if d, ok := fs.minted[key]; ok {
+		return d.cache
+	}
+
+	return nil
+}
+
+// mintedKeys returns the keys tokens have been minted for, sorted.
+func (fs *TokenFS) mintedKeys() []mintKey {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var keys []mintKey
+	for key := range fs.minted {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].audience != keys[j].audience {
+			return keys[i].audience < keys[j].audience
+		}
+		return keys[i].expiration < keys[j].expiration
+	})
+
+	return keys
+}
+
+func (fs *TokenFS) mintInode() fuseops.InodeID {
+	return fs.inode("/"+mintDir, func() node {
+		return &audiencesDir{fs: fs}
+	})
+}
+
+func (fs *TokenFS) mintDirAttributes() (fuseops.InodeAttributes, error) {
+	return fs.dirAttributes(fs.lastModified()), nil
+}
+
+// audiencesDir is aud/, it lists the audiences tokens have been minted for and resolves any other.
+type audiencesDir struct {
+	fs *TokenFS
+}
+
+func (d *audiencesDir) attributes(ctx context.Context) (fuseops.InodeAttributes, error) {
+	return d.fs.mintDirAttributes()
+}
+
+func (d *audiencesDir) audienceInode(audience string) fuseops.InodeID {
+	return d.fs.inode("/"+mintDir+"/"+url.PathEscape(audience), func() node {
+		return &audienceDir{fs: d.fs, audience: audience}
+	})
+}
+
+func (d *audiencesDir) children(ctx context.Context) ([]child, error) {
+	var children []child
+
+	seen := map[string]bool{}
+	for _, key := range d.fs.mintedKeys() {
+		if seen[key.audience] {
+			continue
+		}
+		seen[key.audience] = true
+
+		children = append(children, child{
+			name: url.PathEscape(key.audience),
+			id:   d.audienceInode(key.audience),
+		})
+	}
+
+	return children, nil
+}
+
+func (d *audiencesDir) lookUp(ctx context.Context, name string) (fuseops.InodeID, error) {
+	audience, err := url.PathUnescape(name)
+	if err != nil || audience == "" {
+		return 0, fuse.ENOENT
+	}
+
+	return d.audienceInode(audience), nil
+}
+
+// audienceDir is aud/<audience>/, it only holds exp.
+type audienceDir struct {
+	fs       *TokenFS
+	audience string
+}
+
+func (d *audienceDir) evictable() {}
+
+func (d *audienceDir) attributes(ctx context.Context) (fuseops.InodeAttributes, error) {
+	return d.fs.mintDirAttributes()
+}
+
+func (d *audienceDir) children(ctx context.Context) ([]child, error) {
+	path := "/" + mintDir + "/" + url.PathEscape(d.audience) + "/exp"
+
+	return []child{
+		{
+			name: "exp",
+			id: d.fs.inode(path, func() node {
+				return &expirationsDir{fs: d.fs, audience: d.audience}
+			}),
+		},
+	}, nil
+}
+
+// expirationsDir is aud/<audience>/exp/, it lists the expirations tokens have been minted with for the
+// audience and resolves any other.
+type expirationsDir struct {
+	fs       *TokenFS
+	audience string
+}
+
+func (d *expirationsDir) evictable() {}
+
+func (d *expirationsDir) attributes(ctx context.Context) (fuseops.InodeAttributes, error) {
+	return d.fs.mintDirAttributes()
+}
+
+func (d *expirationsDir) expirationInode(expiration int64) fuseops.InodeID {
+	key := mintKey{
+		audience:   d.audience,
+		expiration: expiration,
+	}
+
+	return d.fs.inode("/"+key.String(), func() node {
+		return &mintedDir{fs: d.fs, key: key}
+	})
+}
+
+func (d *expirationsDir) children(ctx context.Context) ([]child, error) {
+	var children []child
+
+	for _, key := range d.fs.mintedKeys() {
+		if key.audience != d.audience {
+			continue
+		}
+
+		children = append(children, child{
+			name: strconv.FormatInt(key.expiration, 10),
+			id:   d.expirationInode(key.expiration),
+		})
+	}
+
+	return children, nil
+}
+
+func (d *expirationsDir) lookUp(ctx context.Context, name string) (fuseops.InodeID, error) {
+	expiration, err := strconv.ParseInt(name, 10, 64)
+	if err != nil || expiration < tokensource.MinExpirationSeconds || name != strconv.FormatInt(expiration, 10) {
+		return 0, fuse.ENOENT
+	}
+
+	return d.expirationInode(expiration), nil
+}
+
+// mintedDir is aud/<audience>/exp/<seconds>/, holding the token minted for them. The token is only minted
+// once it is used, not when the directory is listed or something else is looked up in it.
+type mintedDir struct {
+	fs  *TokenFS
+	key mintKey
+}
+
+func (d *mintedDir) evictable() {}
+
+func (d *mintedDir) attributes(ctx context.Context) (fuseops.InodeAttributes, error) {
+	return d.fs.mintDirAttributes()
+}
+
+func (d *mintedDir) tokenInode() fuseops.InodeID {
+	return d.fs.inode("/"+d.key.String()+"/token", func() node {
+		return &demandFile{
+			fs: d.fs,
+			file: file{
+				name:     "token",
+				contents: tokenContents,
+			},
+			cache: func() *tokensource.Cache {
+				return d.fs.mintedCache(d.key)
+			},
+			cached: func() *tokensource.Cache {
+				return d.fs.mintedCacheInUse(d.key)
+			},
+		}
+	})
+}
+
+func (d *mintedDir) children(ctx context.Context) ([]child, error) {
+	return []child{
+		{
+			name: "token",
+			id:   d.tokenInode(),
+		},
+	}, nil
+}
+
+func (d *mintedDir) lookUp(ctx context.Context, name string) (fuseops.InodeID, error) {
+	if name != "token" {
+		return 0, fuse.ENOENT
+	}
+
+	return d.tokenInode(), nil
+}
@@ -0,0 +1,256 @@
+package tokenfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+
+	"github.com/ekristen/satokens/pkg/tokensource"
+)
+
+// testMinter mints tokens whose jti is the audience and expiration they were minted for, and counts them.
+type testMinter struct {
+	testSource
+
+	mu    sync.Mutex
+	mints map[mintKey]int
+}
+
+func (m *testMinter) Mint(audience string, expirationSeconds int64) tokensource.TokenSource {
+	key := mintKey{audience: audience, expiration: expirationSeconds}
+
+	return &mintedSource{minter: m, key: key}
+}
+
+func (m *testMinter) minted(key mintKey) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.mints[key]
+}
+
+type mintedSource struct {
+	minter *testMinter
+	key    mintKey
+}
+
+func (s *mintedSource) Token(ctx context.Context) (*tokensource.Token, error) {
+	s.minter.mu.Lock()
+	defer s.minter.mu.Unlock()
+
+	if s.minter.mints == nil {
+		s.minter.mints = map[mintKey]int{}
+	}
+	s.minter.mints[s.key]++
+
+	return testToken(fmt.Sprintf("%s/%d", s.key.audience, s.key.expiration), time.Now()), nil
+}
+
+func newMintFS(t *testing.T) (*TokenFS, *testMinter) {
+	t.Helper()
+
+	minter := &testMinter{testSource: testSource{token: testToken("default", time.Now())}}
+
+	return newTestFS(t, minter, Config{Minter: minter}), minter
+}
+
+func TestMintLookUpDoesNotMint(t *testing.T) {
+	fs, minter := newMintFS(t)
+	key := mintKey{audience: "vault", expiration: 3600}
+
+	id, err := lookUpPath(fs, "aud/vault/exp/3600/token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	op := &fuseops.GetInodeAttributesOp{Inode: id, OpContext: testOp}
+	if err := fs.GetInodeAttributes(context.Background(), op); err != nil {
+		t.Fatal(err)
+	}
+	if op.Attributes.Size != 0 {
+		t.Errorf("size = %d before the token was read, want 0", op.Attributes.Size)
+	}
+
+	if names, err := readDir(fs, "aud/vault/exp/3600", 4096); err != nil || len(names) != 1 || names[0] != "token" {
+		t.Errorf("aud/vault/exp/3600 = %q, %v, want token", names, err)
+	}
+
+	if minter.minted(key) != 0 {
+		t.Errorf("minted %d tokens, want none until token is read", minter.minted(key))
+	}
+
+	// nothing was minted, so there is nothing to list either
+	if names, err := readDir(fs, "aud", 4096); err != nil || len(names) != 0 {
+		t.Errorf("aud = %q, %v, want nothing", names, err)
+	}
+}
+
+func TestMint(t *testing.T) {
+	fs, minter := newMintFS(t)
+
+	tests := []struct {
+		name string
+		path string
+		key  mintKey
+	}{
+		{name: "audience", path: "aud/vault/exp/3600/token", key: mintKey{audience: "vault", expiration: 3600}},
+		{name: "expiration", path: "aud/vault/exp/600/token", key: mintKey{audience: "vault", expiration: 600}},
+		{name: "escaped", path: "aud/%2F%2Fiam.googleapis.com/exp/7200/token", key: mintKey{audience: "//iam.googleapis.com", expiration: 7200}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := testToken(fmt.Sprintf("%s/%d", tt.key.audience, tt.key.expiration), time.Now())
+
+			// read twice, both are served from the same cache
+			for i := 0; i < 2; i++ {
+				contents, err := readFile(fs, tt.path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(contents) != string(want.Contents) {
+					t.Errorf("%s = %q, want the token minted for %s", tt.path, contents, tt.key)
+				}
+			}
+
+			if minter.minted(tt.key) != 1 {
+				t.Errorf("minted %d tokens, want 1", minter.minted(tt.key))
+			}
+
+			id, _ := lookUpPath(fs, tt.path)
+			op := &fuseops.GetInodeAttributesOp{Inode: id, OpContext: testOp}
+			if err := fs.GetInodeAttributes(context.Background(), op); err != nil {
+				t.Fatal(err)
+			}
+			if op.Attributes.Size != uint64(len(want.Contents)) {
+				t.Errorf("size = %d once read, want %d", op.Attributes.Size, len(want.Contents))
+			}
+		})
+	}
+
+	audiences, err := readDir(fs, "aud", 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(audiences) != 2 || audiences[0] != "%2F%2Fiam.googleapis.com" || audiences[1] != "vault" {
+		t.Errorf("aud = %q, want the audiences minted for", audiences)
+	}
+
+	expirations, err := readDir(fs, "aud/vault/exp", 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expirations) != 2 || expirations[0] != "600" || expirations[1] != "3600" {
+		t.Errorf("aud/vault/exp = %q, want the expirations minted with", expirations)
+	}
+}
+
+func TestMintInvalidPaths(t *testing.T) {
+	fs, _ := newMintFS(t)
+
+	tests := []struct {
+		name string
+		path string
+	}{
+		{name: "too short", path: "aud/vault/exp/599"},
+		{name: "not canonical", path: "aud/vault/exp/0600"},
+		{name: "not a number", path: "aud/vault/exp/hour"},
+		{name: "negative", path: "aud/vault/exp/-3600"},
+		{name: "bad escape", path: "aud/%zz"},
+		{name: "other file", path: "aud/vault/exp/3600/ca.crt"},
+		{name: "other directory", path: "aud/vault/iat"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := lookUpPath(fs, tt.path); !errors.Is(err, fuse.ENOENT) {
+				t.Errorf("looking up %s: %v, want ENOENT", tt.path, err)
+			}
+		})
+	}
+}
+
+func TestMintDisabled(t *testing.T) {
+	fs := newTestFS(t, &testSource{token: testToken("first", time.Now())}, Config{})
+
+	if _, err := lookUpPath(fs, "aud"); !errors.Is(err, fuse.ENOENT) {
+		t.Errorf("looking up aud: %v, want ENOENT without a minter", err)
+	}
+}
+
+func TestEvictIdle(t *testing.T) {
+	fs, minter := newMintFS(t)
+	key := mintKey{audience: "vault", expiration: 3600}
+
+	if _, err := readFile(fs, "aud/vault/exp/3600/token"); err != nil {
+		t.Fatal(err)
+	}
+
+	// used just now, kept
+	fs.evictIdle(time.Now())
+	if len(fs.mintedKeys()) != 1 {
+		t.Fatalf("minted keys = %v, want the key in use", fs.mintedKeys())
+	}
+
+	fs.evictIdle(time.Now().Add(idleCacheTTL))
+	if len(fs.mintedKeys()) != 0 {
+		t.Fatalf("minted keys = %v after %s, want none", fs.mintedKeys(), idleCacheTTL)
+	}
+
+	// reading it again mints a new one
+	if _, err := readFile(fs, "aud/vault/exp/3600/token"); err != nil {
+		t.Fatal(err)
+	}
+	if minter.minted(key) != 2 {
+		t.Errorf("minted %d tokens, want 2", minter.minted(key))
+	}
+}
+
+func TestForgetInode(t *testing.T) {
+	fs, _ := newMintFS(t)
+
+	tests := []struct {
+		name    string
+		path    string
+		dropped bool
+	}{
+		{name: "audience", path: "aud/vault", dropped: true},
+		{name: "minted token", path: "aud/vault/exp/3600/token", dropped: true},
+		{name: "aud", path: "aud"},
+		{name: "token", path: "token"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := lookUpPath(fs, tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// looked up once more, only dropped once both are forgotten
+			if _, err := lookUpPath(fs, tt.path); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := fs.ForgetInode(context.Background(), &fuseops.ForgetInodeOp{Inode: id, N: 1}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := fs.node(id); err != nil {
+				t.Fatalf("inode of %s dropped while still referenced", tt.path)
+			}
+
+			if err := fs.ForgetInode(context.Background(), &fuseops.ForgetInodeOp{Inode: id, N: 1}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := fs.node(id); (err != nil) != tt.dropped {
+				t.Errorf("inode of %s dropped: %v, want %v", tt.path, err != nil, tt.dropped)
+			}
+		})
+	}
+}
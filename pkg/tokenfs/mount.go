@@ -0,0 +1,36 @@
+package tokenfs
+
+import (
+	"context"
+	"fmt"
+	"github.com/jacobsa/fuse"
+	"github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+// Unmount unmounts dir, retrying while the kernel reports it busy until ctx is done.
+func Unmount(ctx context.Context, dir string) error {
+	delay := 10 * time.Millisecond
+	for {
+		err := fuse.Unmount(dir)
+		if err == nil {
+			return err
+		}
+
+		if strings.Contains(err.Error(), "resource busy") {
+			logrus.Warn("Resource busy error while unmounting; trying again")
+
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("unmount: %v", err)
+			case <-time.After(delay):
+			}
+
+			delay = time.Duration(1.3 * float64(delay))
+			continue
+		}
+
+		return fmt.Errorf("unmount: %v", err)
+	}
+}
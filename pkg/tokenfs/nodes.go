@@ -0,0 +1,219 @@
+package tokenfs
+
+import (
+	"context"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// node is anything that has an inode in the filesystem.
+type node interface {
+	attributes(ctx context.Context) (fuseops.InodeAttributes, error)
+}
+
+type dirNode interface {
+	node
+	children(ctx context.Context) ([]child, error)
+}
+
+// lookUpDir is implemented by directories that can resolve names they don't list.
+type lookUpDir interface {
+	dirNode
+	lookUp(ctx context.Context, name string) (fuseops.InodeID, error)
+}
+
+type fileNode interface {
+	node
+	name() string
+	secret() bool // contains a token
+	read(ctx context.Context) ([]byte, error)
+}
+
+// writableNode is a file that accepts writes, every other file is read-only.
+type writableNode interface {
+	fileNode
+	write(ctx context.Context, data []byte) error
+}
+
+type symlinkNode interface {
+	node
+	target(ctx context.Context) (string, error)
+}
+
+// child is an entry of a directory.
+type child struct {
+	name string
+	id   fuseops.InodeID
+}
+
+func lookUp(ctx context.Context, d dirNode, name string) (fuseops.InodeID, error) {
+	if l, ok := d.(lookUpDir); ok {
+		return l.lookUp(ctx, name)
+	}
+
+	children, err := d.children(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, c := range children {
+		if c.name == name {
+			return c.id, nil
+		}
+	}
+
+	return 0, fuse.ENOENT
+}
+
+func direntType(n node) fuseutil.DirentType {
+	switch n.(type) {
+	case dirNode:
+		return fuseutil.DT_Directory
+	case symlinkNode:
+		return fuseutil.DT_Link
+	default:
+		return fuseutil.DT_File
+	}
+}
+
+//--------------------------------------------------------------------------------------------------------------
+
+// rootDir presents the serviceaccount directory in the configured layout.
+type rootDir struct {
+	fs *TokenFS
+}
+
+func (d *rootDir) attributes(ctx context.Context) (fuseops.InodeAttributes, error) {
+	if d.fs.config.Layout == LayoutAtomic {
+		return d.fs.dirAttributes(d.fs.published()), nil
+	}
+
+	return d.fs.dirAttributes(d.fs.lastModified()), nil
+}
+
+// lookUp resolves .control and aud without listing the files, so they keep working when no token can be fetched.
+func (d *rootDir) lookUp(ctx context.Context, name string) (fuseops.InodeID, error) {
+	if name == controlName {
+		return d.fs.controlInode(), nil
+	}
+
+	if name == mintDir && d.fs.minter() != nil {
+		return d.fs.mintInode(), nil
+	}
+
+	if d.fs.config.Layout == LayoutBrowse {
+		return d.fs.lookUpNamespace(ctx, name)
+	}
+
+	children, err := d.children(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, c := range children {
+		if c.name == name {
+			return c.id, nil
+		}
+	}
+
+	return 0, fuse.ENOENT
+}
+
+func (d *rootDir) children(ctx context.Context) ([]child, error) {
+	var children []child
+	var err error
+
+	switch d.fs.config.Layout {
+	case LayoutAtomic:
+		children, err = d.fs.atomicChildren(ctx)
+	case LayoutBrowse:
+		children, err = d.fs.namespaceChildren(ctx)
+	default:
+		children, err = d.flatChildren(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if d.fs.minter() != nil {
+		children = append(children, child{
+			name: mintDir,
+			id:   d.fs.mintInode(),
+		})
+	}
+
+	return append(children, child{
+		name: controlName,
+		id:   d.fs.controlInode(),
+	}), nil
+}
+
+func (d *rootDir) flatChildren(ctx context.Context) ([]child, error) {
+	files, err := d.fs.files(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var children []child
+	for _, f := range files {
+		f := f
+		children = append(children, child{
+			name: f.name,
+			id: d.fs.inode("/"+f.name, func() node {
+				return &liveFile{fs: d.fs, file: f}
+			}),
+		})
+	}
+
+	return children, nil
+}
+
+// liveFile always reads the current token of its cache.
+type liveFile struct {
+	fs   *TokenFS
+	file file
+}
+
+func (n *liveFile) attributes(ctx context.Context) (fuseops.InodeAttributes, error) {
+	token, err := n.fs.token(ctx, n.file.cache)
+	if err != nil {
+		return fuseops.InodeAttributes{}, err
+	}
+
+	return n.fs.fileAttributes(len(n.file.contents(token)), n.fs.modified(n.file.cache, token), n.file.public), nil
+}
+
+func (n *liveFile) name() string {
+	return n.file.name
+}
+
+func (n *liveFile) secret() bool {
+	return !n.file.public
+}
+
+func (n *liveFile) read(ctx context.Context) ([]byte, error) {
+	token, err := n.fs.token(ctx, n.file.cache)
+	if err != nil {
+		return nil, err
+	}
+
+	return n.file.contents(token), nil
+}
+
+// symlink points at a fixed target.
+type symlink struct {
+	fs    *TokenFS
+	to    string
+	mtime time.Time
+}
+
+func (n *symlink) attributes(ctx context.Context) (fuseops.InodeAttributes, error) {
+	return n.fs.symlinkAttributes(n.to, n.mtime), nil
+}
+
+func (n *symlink) target(ctx context.Context) (string, error) {
+	return n.to, nil
+}
@@ -0,0 +1,265 @@
+package tokenfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/sirupsen/logrus"
+
+	"github.com/ekristen/satokens/pkg/tokensource"
+)
+
+// Codes of the notifications the filesystem sends the kernel, from include/uapi/linux/fuse.h.
+const (
+	notifyInvalInode = 2
+	notifyInvalEntry = 3
+)
+
+// notifier tells the kernel to drop what it cached about inodes and entries that changed. jacobsa/fuse has no
+// API for notifications, they are written to the device of the mount like libfuse does.
+type notifier struct {
+	mu    sync.Mutex
+	write func(msg []byte) error // GUARDED_BY(mu), nil once the mount is gone
+}
+
+// The messages are the structs of include/uapi/linux/fuse.h in the byte order of the kernel.
+type outHeader struct {
+	Len    uint32
+	Error  int32 // the notification code
+	Unique uint64
+}
+
+type invalInodeOut struct {
+	Ino uint64
+	Off int64
+	Len int64
+}
+
+type invalEntryOut struct {
+	Parent  uint64
+	Namelen uint32
+	Padding uint32
+}
+
+// notification returns a message with the header of code, unique is zero for notifications.
+func notification(code int32, payload []byte) []byte {
+	header := outHeader{
+		Len:   uint32(unsafe.Sizeof(outHeader{})) + uint32(len(payload)),
+		Error: code,
+	}
+
+	msg := append([]byte(nil), (*[unsafe.Sizeof(outHeader{})]byte)(unsafe.Pointer(&header))[:]...)
+	return append(msg, payload...)
+}
+
+// invalInode drops the attributes and every cached page of id, a length of 0 covers the whole file.
+func invalInode(id fuseops.InodeID) []byte {
+	out := invalInodeOut{
+		Ino: uint64(id),
+	}
+
+	return notification(notifyInvalInode, (*[unsafe.Sizeof(invalInodeOut{})]byte)(unsafe.Pointer(&out))[:])
+}
+
+// invalEntry drops the entry name of parent, the name follows the struct and is NUL terminated.
+func invalEntry(parent fuseops.InodeID, name string) []byte {
+	out := invalEntryOut{
+		Parent:  uint64(parent),
+		Namelen: uint32(len(name)),
+	}
+
+	payload := append([]byte(nil), (*[unsafe.Sizeof(invalEntryOut{})]byte)(unsafe.Pointer(&out))[:]...)
+	payload = append(payload, name...)
+
+	return notification(notifyInvalEntry, append(payload, 0))
+}
+
+func (n *notifier) send(msg []byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.write == nil {
+		return
+	}
+
+	err := n.write(msg)
+	switch {
+	case err == nil, errors.Is(err, syscall.ENOENT):
+		// the kernel doesn't know the inode or entry, it has nothing to drop
+	case errors.Is(err, syscall.ENOSYS):
+		logrus.Warn("the kernel doesn't support notifications, rotated tokens are only seen on the next lookup")
+		n.write = nil
+	default:
+		logrus.WithError(err).Debug("unable to notify the kernel")
+	}
+}
+
+func (n *notifier) close() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.write = nil
+}
+
+// server is the fuse.Server NewTokenFS returns, Mount uses it to hand the device of the mount to the filesystem.
+type server struct {
+	fuse.Server
+	fs *TokenFS
+}
+
+// Mount mounts server, as returned by NewTokenFS, on dir. Once mounted, the kernel is told to drop what it
+// cached about a token whenever it rotates.
+func Mount(dir string, s fuse.Server, cfg *fuse.MountConfig) (*fuse.MountedFileSystem, error) {
+	before, _ := deviceFDs()
+
+	mfs, err := fuse.Mount(dir, s, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	tfs, ok := s.(*server)
+	if !ok {
+		return mfs, nil
+	}
+
+	after, err := deviceFDs()
+	if err != nil {
+		logrus.WithError(err).Debug("unable to find the device of the mount, rotated tokens are only seen on the next lookup")
+		return mfs, nil
+	}
+
+	var fds []int
+	for _, fd := range after {
+		if !containsFD(before, fd) {
+			fds = append(fds, fd)
+		}
+	}
+
+	if len(fds) != 1 {
+		logrus.Warn("unable to find the device of the mount, rotated tokens are only seen on the next lookup")
+		return mfs, nil
+	}
+
+	fd := fds[0]
+	tfs.fs.attach(&notifier{
+		write: func(msg []byte) error {
+			_, err := syscall.Write(fd, msg)
+			return err
+		},
+	})
+
+	return mfs, nil
+}
+
+// deviceFDs returns the file descriptors of the process that are open on /dev/fuse.
+func deviceFDs() ([]int, error) {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return nil, err
+	}
+
+	var fds []int
+	for _, entry := range entries {
+		target, err := os.Readlink(filepath.Join("/proc/self/fd", entry.Name()))
+		if err != nil || target != "/dev/fuse" {
+			continue
+		}
+
+		var fd int
+		if _, err := fmt.Sscan(entry.Name(), &fd); err == nil {
+			fds = append(fds, fd)
+		}
+	}
+
+	return fds, nil
+}
+
+func containsFD(fds []int, fd int) bool {
+	for _, f := range fds {
+		if f == fd {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (fs *TokenFS) newServer() fuse.Server {
+	return &server{
+		Server: fuseutil.NewFileSystemServer(fs),
+		fs:     fs,
+	}
+}
+
+func (fs *TokenFS) attach(n *notifier) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.notifier = n
+}
+
+// notifyChanges invalidates the inodes the kernel holds whenever the token of cache changes, starting with the
+// change that closes changed, until ctx is done.
+func (fs *TokenFS) notifyChanges(ctx context.Context, cache *tokensource.Cache, changed <-chan struct{}) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		}
+
+		changed = cache.Changed()
+		fs.invalidate()
+	}
+}
+
+// invalidate drops the attributes and contents of every inode the kernel holds that can change with a token, and
+// the ..data entry of the atomic layout so that the next lookup publishes the new generation.
+func (fs *TokenFS) invalidate() {
+	fs.mu.Lock()
+	n := fs.notifier
+
+	var ids []fuseops.InodeID
+	for id := range fs.lookups {
+		switch fs.inodes[id].(type) {
+		case *snapshotFile, *generationDir, *symlink, nil:
+			// never change
+		default:
+			ids = append(ids, id)
+		}
+	}
+	fs.mu.Unlock()
+
+	if n == nil {
+		return
+	}
+
+	for _, id := range ids {
+		n.send(invalInode(id))
+	}
+
+	if fs.config.Layout == LayoutAtomic {
+		n.send(invalEntry(fuseops.RootInodeID, dataDir))
+	}
+}
+
+// invalidateEntry drops the entry name of parent, it must not be called while an op on parent is handled as the
+// kernel locks the directory to drop it.
+func (fs *TokenFS) invalidateEntry(parent fuseops.InodeID, name string) {
+	fs.mu.Lock()
+	n := fs.notifier
+	fs.mu.Unlock()
+
+	if n != nil {
+		n.send(invalEntry(parent, name))
+	}
+}
@@ -0,0 +1,180 @@
+package tokenfs
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+func TestNotificationMessages(t *testing.T) {
+	headerSize := int(unsafe.Sizeof(outHeader{}))
+
+	tests := []struct {
+		name    string
+		msg     []byte
+		code    int32
+		size    int
+		payload func(t *testing.T, payload []byte)
+	}{
+		{
+			name: "inval inode",
+			msg:  invalInode(42),
+			code: notifyInvalInode,
+			size: headerSize + int(unsafe.Sizeof(invalInodeOut{})),
+			payload: func(t *testing.T, payload []byte) {
+				out := *(*invalInodeOut)(unsafe.Pointer(&payload[0]))
+				if out != (invalInodeOut{Ino: 42}) {
+					t.Errorf("payload = %+v, want inode 42 from offset 0 to the end", out)
+				}
+			},
+		},
+		{
+			name: "inval entry",
+			msg:  invalEntry(fuseops.RootInodeID, dataDir),
+			code: notifyInvalEntry,
+			size: headerSize + int(unsafe.Sizeof(invalEntryOut{})) + len(dataDir) + 1,
+			payload: func(t *testing.T, payload []byte) {
+				out := *(*invalEntryOut)(unsafe.Pointer(&payload[0]))
+				if out != (invalEntryOut{Parent: fuseops.RootInodeID, Namelen: uint32(len(dataDir))}) {
+					t.Errorf("payload = %+v, want the root and the length of %s", out, dataDir)
+				}
+
+				if name := string(payload[unsafe.Sizeof(invalEntryOut{}):]); name != dataDir+"\x00" {
+					t.Errorf("name = %q, want %q", name, dataDir+"\x00")
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if len(tt.msg) != tt.size {
+				t.Fatalf("message is %d bytes, want %d", len(tt.msg), tt.size)
+			}
+
+			header := *(*outHeader)(unsafe.Pointer(&tt.msg[0]))
+			if header != (outHeader{Len: uint32(tt.size), Error: tt.code}) {
+				t.Errorf("header = %+v, want length %d and code %d", header, tt.size, tt.code)
+			}
+
+			tt.payload(t, tt.msg[headerSize:])
+		})
+	}
+}
+
+// testNotifier records the notifications sent to the kernel.
+type testNotifier struct {
+	mu   sync.Mutex
+	msgs [][]byte
+}
+
+func (n *testNotifier) write(msg []byte) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.msgs = append(n.msgs, msg)
+	return nil
+}
+
+func (n *testNotifier) sent(msg []byte) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, m := range n.msgs {
+		if string(m) == string(msg) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestInvalidateOnRotation(t *testing.T) {
+	tests := []struct {
+		name   string
+		layout string
+	}{
+		{name: "flat", layout: LayoutFlat},
+		{name: "atomic", layout: LayoutAtomic},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := &testSource{token: testToken("first", time.Now())}
+			fs := newTestFS(t, source, Config{Layout: tt.layout})
+
+			notifications := &testNotifier{}
+			fs.attach(&notifier{write: notifications.write})
+
+			path := "token"
+			if tt.layout == LayoutAtomic {
+				path = "ttl_seconds"
+			}
+
+			id, err := lookUpPath(fs, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gen, _ := readLink(fs, dataDir)
+
+			source.set(testToken("second", time.Now()))
+			if _, err := fs.cache.Refresh(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			waitFor(t, func() bool { return notifications.sent(invalInode(id)) })
+
+			if tt.layout != LayoutAtomic {
+				return
+			}
+
+			waitFor(t, func() bool { return notifications.sent(invalEntry(fuseops.RootInodeID, dataDir)) })
+
+			// the generation that is no longer listed is dropped once the new one is published
+			if _, err := readLink(fs, dataDir); err != nil {
+				t.Fatal(err)
+			}
+			waitFor(t, func() bool { return notifications.sent(invalEntry(fuseops.RootInodeID, gen)) })
+		})
+	}
+}
+
+func TestInvalidateWithoutNotifier(t *testing.T) {
+	source := &testSource{token: testToken("first", time.Now())}
+	fs := newTestFS(t, source, Config{})
+
+	if _, err := lookUpPath(fs, "token"); err != nil {
+		t.Fatal(err)
+	}
+
+	// not mounted through Mount, nothing to notify
+	fs.invalidate()
+
+	notifications := &testNotifier{}
+	n := &notifier{write: notifications.write}
+	fs.attach(n)
+	fs.Destroy()
+
+	// the device is closed once the filesystem is destroyed
+	n.send(invalInode(fuseops.RootInodeID))
+	if len(notifications.msgs) != 0 {
+		t.Errorf("sent %d notifications after Destroy, want none", len(notifications.msgs))
+	}
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
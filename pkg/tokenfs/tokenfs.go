@@ -1,68 +1,599 @@
 package tokenfs
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/ekristen/satokens/pkg/tokensource"
 	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/fuseutil"
-	"log"
-	"net/http"
+	"github.com/sirupsen/logrus"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 )
 
-func NewTokenFS() (fuse.Server, error) {
-	fs := &TokenFS{}
+// Layouts of the root directory.
+const (
+	// LayoutFlat puts the files straight into the root directory.
+	LayoutFlat = "flat"
+
+	// LayoutAtomic mirrors the AtomicWriter kubelet uses for projected volumes: the files live in a timestamped
+	// directory that ..data points at and the root only holds symlinks through ..data. A new directory is
+	// published and ..data swapped whenever a token rotates.
+	LayoutAtomic = "atomic"
+
+	// LayoutBrowse presents a directory per namespace holding a directory per service account, each with
+	// the files of the serviceaccount directory and a token minted on demand.
+	LayoutBrowse = "browse"
+)
+
+// Config controls how the token filesystem serves tokens.
+type Config struct {
+	// RefreshFraction is the fraction of a token's lifetime after which it is refreshed in the background,
+	// defaults to tokensource.DefaultRefreshFraction.
+	RefreshFraction float64
+
+	// ServeStale keeps serving the last known good token until it expires when the source is failing.
+	ServeStale bool
+
+	// Layout of the root directory, LayoutFlat when empty.
+	Layout string
+
+	// UID and GID own every inode, nil for the user and group of the mounting process.
+	UID, GID *uint32
+
+	// FileMode is the permissions of the tokens, DefaultFileMode when zero. Like kubelet does, ca.crt and
+	// namespace are additionally readable by everyone as they aren't secret.
+	FileMode os.FileMode
+
+	// DirMode is the permissions of the directories, DefaultDirMode when zero.
+	DirMode os.FileMode
+
+	// Access restricts which processes can open and read tokens.
+	Access AccessPolicy
+
+	// Browser lists the namespaces and service accounts of LayoutBrowse.
+	Browser Browser
+
+	// Minter, when set, mints the tokens of the aud/<audience>/exp/<seconds>/token tree, which isn't served
+	// otherwise or with LayoutBrowse.
+	Minter tokensource.MintingSource
+
+	// Connection, when set, is reported on and can be reset through the .control file.
+	Connection Connection
+
+	// Source describes where the tokens come from, exposed as the user.satokens.source extended attribute.
+	Source string
+
+	// Audit records every open and read of a token along with the tokens that were issued, when set.
+	Audit *AuditLog
+}
+
+const (
+	DefaultFileMode os.FileMode = 0600
+	DefaultDirMode  os.FileMode = 0755
+
+	// publicFileMode is added to the permissions of files that don't contain a token.
+	publicFileMode os.FileMode = 0044
+)
 
-	return fuseutil.NewFileSystemServer(fs), nil
+// NewTokenFS returns a filesystem serving the tokens of source, which may be nil for LayoutBrowse.
+func NewTokenFS(source tokensource.TokenSource, cfg Config) (fuse.Server, error) {
+	fs, err := newTokenFS(source, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return fs.newServer(), nil
 }
 
+func newTokenFS(source tokensource.TokenSource, cfg Config) (*TokenFS, error) {
+	switch cfg.Layout {
+	case "":
+		cfg.Layout = LayoutFlat
+	case LayoutFlat, LayoutAtomic:
+	case LayoutBrowse:
+		if cfg.Browser == nil {
+			return nil, fmt.Errorf("the browse layout requires a browser")
+		}
+	default:
+		return nil, fmt.Errorf("unknown layout: %s", cfg.Layout)
+	}
+
+	if source == nil && cfg.Layout != LayoutBrowse {
+		return nil, fmt.Errorf("token source is required")
+	}
+
+	if err := cfg.Access.resolve(); err != nil {
+		return nil, err
+	}
+
+	if cfg.Layout == LayoutBrowse {
+		// aud would clash with a namespace of the same name
+		cfg.Minter = nil
+	}
+
+	if cfg.UID == nil {
+		uid := uint32(os.Getuid())
+		cfg.UID = &uid
+	}
+	if cfg.GID == nil {
+		gid := uint32(os.Getgid())
+		cfg.GID = &gid
+	}
+	if cfg.FileMode == 0 {
+		cfg.FileMode = DefaultFileMode
+	}
+	if cfg.DirMode == 0 {
+		cfg.DirMode = DefaultDirMode
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	fs := &TokenFS{
+		ctx:       ctx,
+		cancel:    cancel,
+		source:    source,
+		config:    cfg,
+		named:     make(map[string]*tokensource.Cache),
+		minted:    make(map[mintKey]*demandCache),
+		browsed:   make(map[serviceAccount]*demandCache),
+		listings:  make(map[string]*listing),
+		inodes:    make(map[fuseops.InodeID]node),
+		ids:       make(map[string]fuseops.InodeID),
+		paths:     make(map[fuseops.InodeID]string),
+		lookups:   make(map[fuseops.InodeID]uint64),
+		nextInode: fuseops.RootInodeID + 1,
+	}
+
+	go fs.evict(ctx)
+
+	if source != nil {
+		fs.cache = fs.newCache("token", source)
+	}
+
+	fs.inodes[fuseops.RootInodeID] = &rootDir{fs: fs}
+	fs.ids["/"] = fuseops.RootInodeID
+
+	return fs, nil
+}
+
+// TokenFS serves the token out of an in-memory cache that is kept fresh in the background, so no op
+// ever waits on the network unless there is no valid token at all. When no token can be had the op
+// fails with EIO, the filesystem itself keeps running.
 type TokenFS struct {
 	fuseutil.NotImplementedFileSystem
 
-	mu            sync.Mutex
-	tokenContents []byte // GUARDED_BY(mu)
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	source tokensource.TokenSource
+	config Config
+	cache  *tokensource.Cache
+
+	mu        sync.Mutex
+	named     map[string]*tokensource.Cache   // GUARDED_BY(mu)
+	minted    map[mintKey]*demandCache        // GUARDED_BY(mu)
+	browsed   map[serviceAccount]*demandCache // GUARDED_BY(mu)
+	listings  map[string]*listing             // GUARDED_BY(mu), by namespace, the namespaces themselves under ""
+	inodes    map[fuseops.InodeID]node        // GUARDED_BY(mu)
+	ids       map[string]fuseops.InodeID      // GUARDED_BY(mu), by path so a path keeps its inode
+	paths     map[fuseops.InodeID]string      // GUARDED_BY(mu), the reverse of ids
+	lookups   map[fuseops.InodeID]uint64      // GUARDED_BY(mu), lookups the kernel hasn't forgotten
+	nextInode fuseops.InodeID                 // GUARDED_BY(mu)
+	notifier  *notifier                       // GUARDED_BY(mu), nil until mounted with Mount
+
+	// current is the published generation of the atomic layout, previous is kept around so open files
+	// of the last generation can still be read.
+	current  *generation // GUARDED_BY(mu)
+	previous *generation // GUARDED_BY(mu)
 }
 
-const (
-	rootInode fuseops.InodeID = fuseops.RootInodeID + iota
-	tokenInode
-)
+// file is a read-only file whose contents are derived from a token. The static files mirror
+// /var/run/secrets/kubernetes.io/serviceaccount inside a pod, additional tokens sit next to them just
+// like they would in a projected volume.
+type file struct {
+	name     string
+	optional bool // hidden when empty, older servers don't provide everything
+	public   bool // doesn't contain a token
+	volatile bool // changes without the token changing
+	cache    *tokensource.Cache
+	contents func(token *tokensource.Token) []byte
+}
+
+func tokenContents(token *tokensource.Token) []byte {
+	return token.Contents
+}
+
+var staticFiles = []file{
+	{
+		name:     "token",
+		contents: tokenContents,
+	},
+	{
+		name:     "ca.crt",
+		optional: true,
+		public:   true,
+		contents: func(token *tokensource.Token) []byte {
+			return token.CACert
+		},
+	},
+	{
+		name:     "namespace",
+		optional: true,
+		public:   true,
+		contents: func(token *tokensource.Token) []byte {
+			if token.Namespace != "" {
+				return []byte(token.Namespace)
+			}
+
+			namespace, _, _ := token.Claims.ServiceAccount()
+			return []byte(namespace)
+		},
+	},
+
+	// Metadata of the token, so it can be inspected without a decoder.
+	{
+		name:     "claims.json",
+		optional: true,
+		public:   true,
+		contents: func(token *tokensource.Token) []byte {
+			payload, err := tokensource.DecodePayload(token.Contents)
+			if err != nil {
+				return nil
+			}
+
+			var buf bytes.Buffer
+			if err := json.Indent(&buf, payload, "", "  "); err != nil {
+				return nil
+			}
+			buf.WriteByte('\n')
+
+			return buf.Bytes()
+		},
+	},
+	{
+		name:     "expires_at",
+		optional: true,
+		public:   true,
+		contents: func(token *tokensource.Token) []byte {
+			exp := token.ExpiresAt()
+			if exp.IsZero() {
+				return nil
+			}
+
+			return []byte(exp.UTC().Format(time.RFC3339))
+		},
+	},
+	{
+		name:     "ttl_seconds",
+		optional: true,
+		public:   true,
+		volatile: true,
+		contents: func(token *tokensource.Token) []byte {
+			exp := token.ExpiresAt()
+			if exp.IsZero() {
+				return nil
+			}
+
+			ttl := time.Until(exp)
+			if ttl < 0 {
+				ttl = 0
+			}
+
+			return []byte(strconv.FormatInt(int64(ttl/time.Second), 10))
+		},
+	},
+	{
+		name:     "audience",
+		optional: true,
+		public:   true,
+		contents: func(token *tokensource.Token) []byte {
+			if token.Claims == nil {
+				return nil
+			}
+
+			return []byte(strings.Join(token.Claims.Audience, "\n"))
+		},
+	},
+	{
+		name:     "service_account",
+		optional: true,
+		public:   true,
+		contents: func(token *tokensource.Token) []byte {
+			_, name, _ := token.Claims.ServiceAccount()
+			return []byte(name)
+		},
+	},
+}
+
+// ReservedNames returns the names of the files and directories served next to the additional tokens, which
+// can't be used for them. Names starting with a dot are reserved as well.
+func ReservedNames() []string {
+	names := []string{mintDir}
+	for _, f := range staticFiles {
+		names = append(names, f.name)
+	}
+
+	return names
+}
+
+func reserved(name string) bool {
+	if strings.HasPrefix(name, ".") {
+		return true
+	}
+
+	for _, r := range ReservedNames() {
+		if r == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (fs *TokenFS) newCache(name string, source tokensource.TokenSource) *tokensource.Cache {
+	return fs.startCache(fs.ctx, name, source)
+}
+
+// startCache returns a cache of the tokens of source that is kept fresh until ctx is done.
+func (fs *TokenFS) startCache(ctx context.Context, name string, source tokensource.TokenSource) *tokensource.Cache {
+	cache := tokensource.NewCache(source, tokensource.CacheConfig{
+		RefreshFraction: fs.config.RefreshFraction,
+		ServeStale:      fs.config.ServeStale,
+	})
+
+	go cache.Run(ctx)
+	go cache.Watch(ctx)
+	go fs.notifyChanges(ctx, cache, cache.Changed())
+
+	if fs.config.Audit != nil {
+		go fs.auditTokens(ctx, name, cache)
+	}
+
+	return cache
+}
+
+// namedCache returns the cache of the additional token called name, setting it up on first use. It
+// returns nil when the source can't provide named tokens or the name would clash with another file.
+func (fs *TokenFS) namedCache(name string) *tokensource.Cache {
+	named, ok := fs.source.(tokensource.NamedSource)
+	if !ok || name == "" || strings.Contains(name, "/") || reserved(name) {
+		return nil
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if cache, ok := fs.named[name]; ok {
+		return cache
+	}
+
+	cache := fs.newCache(name, named.Named(name))
+	fs.named[name] = cache
+
+	return cache
+}
+
+// files returns the files that currently make up the serviceaccount directory.
+func (fs *TokenFS) files(ctx context.Context) ([]file, error) {
+	files, token, err := fs.staticFiles(ctx, fs.cache)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range token.Additional {
+		cache := fs.namedCache(name)
+		if cache == nil {
+			continue
+		}
+
+		files = append(files, file{
+			name:     name,
+			cache:    cache,
+			contents: tokenContents,
+		})
+	}
+
+	return files, nil
+}
+
+// staticFiles returns the static files for the token of cache, along with the token.
+func (fs *TokenFS) staticFiles(ctx context.Context, cache *tokensource.Cache) ([]file, *tokensource.Token, error) {
+	token, err := fs.token(ctx, cache)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var files []file
+	for _, f := range staticFiles {
+		if f.optional && len(f.contents(token)) == 0 {
+			continue
+		}
+		f.cache = cache
+		files = append(files, f)
+	}
+
+	return files, token, nil
+}
+
+// token returns the current token of cache, translating failures into an errno for the kernel.
+func (fs *TokenFS) token(ctx context.Context, cache *tokensource.Cache) (*tokensource.Token, error) {
+	token, err := cache.Token(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, syscall.EINTR
+		}
+
+		logrus.WithError(err).Warn("unable to get token")
+		return nil, fuse.EIO
+	}
+
+	return token, nil
+}
 
 //--------------------------------------------------------------------------------------------------------------
 
-func (fs *TokenFS) rootAttributes() fuseops.InodeAttributes {
+// inode returns the inode of path, registering the node returned by create if the path is new. create is
+// called with the lock held.
+func (fs *TokenFS) inode(path string, create func() node) fuseops.InodeID {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if id, ok := fs.ids[path]; ok {
+		return id
+	}
+
+	id := fs.nextInode
+	fs.nextInode++
+
+	fs.ids[path] = id
+	fs.paths[id] = path
+	fs.inodes[id] = create()
+
+	return id
+}
+
+// forget drops the inodes of paths that no longer exist.
+func (fs *TokenFS) forget(paths ...string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for _, path := range paths {
+		if id, ok := fs.ids[path]; ok {
+			delete(fs.inodes, id)
+			delete(fs.ids, path)
+			delete(fs.paths, id)
+		}
+	}
+}
+
+func (fs *TokenFS) node(id fuseops.InodeID) (node, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	n, ok := fs.inodes[id]
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+
+	return n, nil
+}
+
+func (fs *TokenFS) dir(id fuseops.InodeID) (dirNode, error) {
+	n, err := fs.node(id)
+	if err != nil {
+		return nil, err
+	}
+
+	d, ok := n.(dirNode)
+	if !ok {
+		return nil, syscall.ENOTDIR
+	}
+
+	return d, nil
+}
+
+// modified returns the time the token of cache last changed, its iat when it has one so that every mount
+// agrees on it. token is the current token of cache, the cached one is used when it is nil.
+func (fs *TokenFS) modified(cache *tokensource.Cache, token *tokensource.Token) time.Time {
+	if token == nil {
+		token = cache.Cached()
+	}
+
+	if token == nil {
+		return time.Time{}
+	}
+
+	if iat := token.IssuedAt(); !iat.IsZero() {
+		return iat
+	}
+
+	return cache.Status().LastChange
+}
+
+// lastModified returns the most recent change of any of the tokens, without calling the source.
+func (fs *TokenFS) lastModified() time.Time {
+	fs.mu.Lock()
+	var caches []*tokensource.Cache
+	if fs.cache != nil {
+		caches = append(caches, fs.cache)
+	}
+	for _, cache := range fs.named {
+		caches = append(caches, cache)
+	}
+	fs.mu.Unlock()
+
+	var latest time.Time
+	for _, cache := range caches {
+		if mtime := fs.modified(cache, nil); mtime.After(latest) {
+			latest = mtime
+		}
+	}
+
+	return latest
+}
+
+func (fs *TokenFS) dirAttributes(mtime time.Time) fuseops.InodeAttributes {
 	return fuseops.InodeAttributes{
 		Nlink: 1,
-		Mode:  0777 | os.ModeDir,
+		Mode:  fs.config.DirMode.Perm() | os.ModeDir,
+		Uid:   *fs.config.UID,
+		Gid:   *fs.config.GID,
+		Mtime: mtime,
+		Ctime: mtime,
 	}
 }
 
-// LOCKS_REQUIRED(fs.mu)
-func (fs *TokenFS) tokenAttributes() fuseops.InodeAttributes {
+func (fs *TokenFS) fileAttributes(size int, mtime time.Time, public bool) fuseops.InodeAttributes {
+	mode := fs.config.FileMode.Perm()
+	if public {
+		mode |= publicFileMode
+	}
+
 	return fuseops.InodeAttributes{
 		Nlink: 1,
-		Mode:  0777,
-		Size:  uint64(len(fs.tokenContents)),
+		Mode:  mode,
+		Uid:   *fs.config.UID,
+		Gid:   *fs.config.GID,
+		Size:  uint64(size),
+		Mtime: mtime,
+		Ctime: mtime,
 	}
 }
 
-// LOCKS_REQUIRED(fs.mu)
-func (fs *TokenFS) getAttributes(id fuseops.InodeID) (fuseops.InodeAttributes, error) {
-	switch id {
-	case fuseops.RootInodeID:
-		return fs.rootAttributes(), nil
-	case tokenInode:
-		return fs.tokenAttributes(), nil
-	default:
-		return fuseops.InodeAttributes{}, fuse.ENOENT
+func (fs *TokenFS) symlinkAttributes(target string, mtime time.Time) fuseops.InodeAttributes {
+	return fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  0777 | os.ModeSymlink,
+		Uid:   *fs.config.UID,
+		Gid:   *fs.config.GID,
+		Size:  uint64(len(target)),
+		Mtime: mtime,
+		Ctime: mtime,
 	}
 }
 
 //--------------------------------------------------------------------------------------------------------------
 
+func (fs *TokenFS) Destroy() {
+	fs.cancel()
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// the device is closed right after
+	if fs.notifier != nil {
+		fs.notifier.close()
+	}
+}
+
 func (fs *TokenFS) StatFS(
 	ctx context.Context,
 	op *fuseops.StatFSOp) error {
@@ -72,26 +603,38 @@ func (fs *TokenFS) StatFS(
 func (fs *TokenFS) LookUpInode(
 	ctx context.Context,
 	op *fuseops.LookUpInodeOp) error {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
-
-	// Sanity check.
-	if op.Parent != fuseops.RootInodeID {
-		return fuse.ENOENT
+	parent, err := fs.dir(op.Parent)
+	if err != nil {
+		return err
 	}
 
-	// Set up the entry.
-	switch op.Name {
-	case "token":
-		op.Entry = fuseops.ChildInodeEntry{
-			Child:      tokenInode,
-			Attributes: fs.tokenAttributes(),
-		}
-		if err := fs.ReadRemoteFile(); err != nil {
+	// Set up the entry, looking it up again should the kernel have had it dropped in the meantime.
+	var id fuseops.InodeID
+	for {
+		if id, err = lookUp(ctx, parent, op.Name); err != nil {
 			return err
 		}
-	default:
-		return fuse.ENOENT
+
+		if fs.ref(id) {
+			break
+		}
+	}
+
+	child, err := fs.node(id)
+	if err != nil {
+		return err
+	}
+
+	attributes, err := child.attributes(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Leave the expirations zero, the kernel has to come back for every lookup and stat so that a rotated
+	// token is never hidden behind cached attributes.
+	op.Entry = fuseops.ChildInodeEntry{
+		Child:      id,
+		Attributes: attributes,
 	}
 
 	return nil
@@ -100,151 +643,270 @@ func (fs *TokenFS) LookUpInode(
 func (fs *TokenFS) GetInodeAttributes(
 	ctx context.Context,
 	op *fuseops.GetInodeAttributesOp) error {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
+	n, err := fs.node(op.Inode)
+	if err != nil {
+		return err
+	}
 
-	var err error
-	op.Attributes, err = fs.getAttributes(op.Inode)
+	op.Attributes, err = n.attributes(ctx)
 	return err
 }
 
 func (fs *TokenFS) SetInodeAttributes(
 	ctx context.Context,
 	op *fuseops.SetInodeAttributesOp) error {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
+	n, err := fs.node(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	changes := op.Size != nil || op.Mode != nil || op.Uid != nil || op.Gid != nil || op.Atime != nil || op.Mtime != nil
+	if _, ok := n.(writableNode); changes && !ok {
+		return syscall.EROFS
+	}
 
 	// Ignore any changes and simply return existing attributes.
-	var err error
-	op.Attributes, err = fs.getAttributes(op.Inode)
+	op.Attributes, err = n.attributes(ctx)
 	return err
 }
 
 func (fs *TokenFS) OpenFile(
 	ctx context.Context,
 	op *fuseops.OpenFileOp) error {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
+	n, err := fs.node(op.Inode)
+	if err != nil {
+		return err
+	}
 
 	// Sanity check.
-	if op.Inode != tokenInode {
-		return fuse.ENOSYS
+	f, ok := n.(fileNode)
+	if !ok {
+		return syscall.EISDIR
+	}
+
+	// The contents change on rotation, possibly to a different length, bypass the page cache so every read
+	// sees the current token. Rotations are also pushed to the kernel, see notify.go.
+	op.KeepPageCache = false
+	op.UseDirectIO = true
+
+	if !op.OpenFlags.IsReadOnly() {
+		// like a projected volume, which kubelet mounts read-only
+		w, ok := f.(writableNode)
+		if !ok {
+			return syscall.EROFS
+		}
+
+		proc, err := fs.authorizeWrite(op.OpContext, w)
+		fs.auditWrite(AuditOpen, op.OpContext, op.Inode, w, proc, err != nil, nil)
+
+		return err
 	}
 
-	if err := fs.ReadRemoteFile(); err != nil {
+	proc, err := fs.authorize(op.OpContext, f)
+	if err != nil {
+		fs.audit(AuditOpen, op.OpContext, op.Inode, f, proc, true, nil)
+		return err
+	}
+
+	contents, err := f.read(ctx)
+	if err != nil {
 		return err
 	}
 
+	fs.audit(AuditOpen, op.OpContext, op.Inode, f, proc, false, contents)
+
 	return nil
 }
 
 func (fs *TokenFS) ReadFile(
 	ctx context.Context,
 	op *fuseops.ReadFileOp) error {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
+	n, err := fs.node(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	f, ok := n.(fileNode)
+	if !ok {
+		return syscall.EISDIR
+	}
 
-	if err := fs.ReadRemoteFile(); err != nil {
+	proc, err := fs.authorize(op.OpContext, f)
+	if err != nil {
+		fs.audit(AuditRead, op.OpContext, op.Inode, f, proc, true, nil)
 		return err
 	}
 
+	contents, err := f.read(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Only audit the start of a read, reading the rest of the token or hitting EOF is the same access.
+	if op.Offset == 0 {
+		fs.audit(AuditRead, op.OpContext, op.Inode, f, proc, false, contents)
+	}
+
 	// Ensure the offset is in range.
-	if op.Offset > int64(len(fs.tokenContents)) {
+	if op.Offset > int64(len(contents)) {
 		return nil
 	}
 
 	// Read what we can.
-	op.BytesRead = copy(op.Dst, fs.tokenContents[op.Offset:])
+	op.BytesRead = copy(op.Dst, contents[op.Offset:])
 
 	return nil
 }
 
-func (fs *TokenFS) OpenDir(
+func (fs *TokenFS) WriteFile(
 	ctx context.Context,
-	op *fuseops.OpenDirOp) error {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
+	op *fuseops.WriteFileOp) error {
+	n, err := fs.node(op.Inode)
+	if err != nil {
+		return err
+	}
 
-	// Sanity check.
-	switch op.Inode {
-	case fuseops.RootInodeID:
-		if err := fs.ReadRemoteFile(); err != nil {
-			return err
-		}
-	default:
-		return fuse.ENOENT
+	w, ok := n.(writableNode)
+	if !ok {
+		return syscall.EROFS
 	}
 
-	return nil
+	proc, err := fs.authorizeWrite(op.OpContext, w)
+	fs.auditWrite(AuditWrite, op.OpContext, op.Inode, w, proc, err != nil, op.Data)
+	if err != nil {
+		return err
+	}
+
+	return w.write(ctx, op.Data)
 }
 
-func (fs *TokenFS) ReadDir(
+// The tree is made up by the filesystem, like a projected volume which kubelet mounts read-only, so every
+// change to it fails with EROFS rather than ENOSYS.
+func (fs *TokenFS) MkDir(
 	ctx context.Context,
-	op *fuseops.ReadDirOp) error {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
+	op *fuseops.MkDirOp) error {
+	return syscall.EROFS
+}
 
-	// Create the appropriate listing.
-	var dirEntries []fuseutil.Dirent
+func (fs *TokenFS) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	return syscall.EROFS
+}
 
-	switch op.Inode {
-	case fuseops.RootInodeID:
-		dirEntries = []fuseutil.Dirent{
-			fuseutil.Dirent{
-				Offset: 1,
-				Inode:  tokenInode,
-				Name:   "token",
-				Type:   fuseutil.DT_File,
-			},
-		}
+func (fs *TokenFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	return syscall.EROFS
+}
 
-	default:
-		return fmt.Errorf("unexpected inode: %v", op.Inode)
-	}
+func (fs *TokenFS) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	return syscall.EROFS
+}
 
-	// If the offset is for the end of the listing, we're done. Otherwise we
-	// expect it to be for the start.
-	switch op.Offset {
-	case fuseops.DirOffset(len(dirEntries)):
-		return nil
+func (fs *TokenFS) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	return syscall.EROFS
+}
 
-	case 0:
+func (fs *TokenFS) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	return syscall.EROFS
+}
 
-	default:
-		return fmt.Errorf("unexpected offset: %v", op.Offset)
-	}
+func (fs *TokenFS) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	return syscall.EROFS
+}
 
-	// Fill in the listing.
-	for _, de := range dirEntries {
-		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], de)
+func (fs *TokenFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	return syscall.EROFS
+}
 
-		// We don't support doing this in anything more than one shot.
-		if n == 0 {
-			return fmt.Errorf("couldn't fit listing in %v bytes", len(op.Dst))
-		}
+func (fs *TokenFS) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	return syscall.EROFS
+}
 
-		op.BytesRead += n
+func (fs *TokenFS) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	n, err := fs.node(op.Inode)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	s, ok := n.(symlinkNode)
+	if !ok {
+		return syscall.EINVAL
+	}
+
+	op.Target, err = s.target(ctx)
+	return err
 }
 
-type Payload struct {
-	Contents []byte `json:"contents"`
+func (fs *TokenFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	// Sanity check.
+	_, err := fs.dir(op.Inode)
+	return err
 }
 
-func (fs *TokenFS) ReadRemoteFile() error {
-	resp, err := http.Get("http://localhost:44044")
+func (fs *TokenFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	d, err := fs.dir(op.Inode)
 	if err != nil {
-		log.Fatalln(err)
+		return err
 	}
 
-	var data Payload
-	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+	children, err := d.children(ctx)
+	if err != nil {
 		return err
 	}
 
-	fs.tokenContents = data.Contents
+	// Create the appropriate listing.
+	var dirEntries []fuseutil.Dirent
+
+	for _, child := range children {
+		n, err := fs.node(child.id)
+		if err != nil {
+			continue
+		}
+
+		dirEntries = append(dirEntries, fuseutil.Dirent{
+			Offset: fuseops.DirOffset(len(dirEntries) + 1),
+			Inode:  child.id,
+			Name:   child.name,
+			Type:   direntType(n),
+		})
+	}
+
+	// The kernel reads long listings, like the namespaces of a cluster, over several calls, each starting at the
+	// offset of the last entry it got. The listing may have changed in the meantime, past its end there's nothing
+	// left to read.
+	if op.Offset > fuseops.DirOffset(len(dirEntries)) {
+		return nil
+	}
+
+	// Fill in as much of the listing as fits.
+	for _, de := range dirEntries[op.Offset:] {
+		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], de)
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
 
 	return nil
 }
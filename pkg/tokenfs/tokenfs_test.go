@@ -0,0 +1,167 @@
+package tokenfs
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+
+	"github.com/ekristen/satokens/pkg/tokensource"
+)
+
+// testToken returns a token for the service account app in namespace default, issued at iat and valid for an
+// hour.
+func testToken(jti string, iat time.Time) *tokensource.Token {
+	payload := fmt.Sprintf(`{"aud":["vault"],"sub":"system:serviceaccount:default:app","jti":%q,"iat":%d,"exp":%d}`,
+		jti, iat.Unix(), iat.Add(time.Hour).Unix())
+
+	token := tokensource.NewToken([]byte("eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".c2ln"))
+	token.CACert = []byte("ca")
+	token.Namespace = "default"
+
+	return token
+}
+
+// testSource serves a token the test can replace and counts the fetches.
+type testSource struct {
+	mu    sync.Mutex
+	token *tokensource.Token
+	err   error
+	calls int
+}
+
+func (s *testSource) Token(ctx context.Context) (*tokensource.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls++
+	return s.token, s.err
+}
+
+func (s *testSource) set(token *tokensource.Token) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.token = token
+}
+
+func (s *testSource) Calls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.calls
+}
+
+func newTestFS(t *testing.T, source tokensource.TokenSource, cfg Config) *TokenFS {
+	t.Helper()
+
+	fs, err := newTokenFS(source, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(fs.Destroy)
+
+	return fs
+}
+
+// testOp is the context of the ops of the tests, this process reads the files.
+var testOp = fuseops.OpContext{Pid: uint32(os.Getpid())}
+
+// lookUpPath looks up every element of path, relative to the root.
+func lookUpPath(fs *TokenFS, path string) (fuseops.InodeID, error) {
+	var id fuseops.InodeID = fuseops.RootInodeID
+
+	for _, name := range strings.Split(path, "/") {
+		if name == "" {
+			continue
+		}
+
+		op := &fuseops.LookUpInodeOp{Parent: id, Name: name, OpContext: testOp}
+		if err := fs.LookUpInode(context.Background(), op); err != nil {
+			return 0, err
+		}
+		id = op.Entry.Child
+	}
+
+	return id, nil
+}
+
+// readFile opens and reads the file at path like cat does.
+func readFile(fs *TokenFS, path string) ([]byte, error) {
+	id, err := lookUpPath(fs, path)
+	if err != nil {
+		return nil, err
+	}
+
+	return readInode(fs, id)
+}
+
+// readInode opens and reads the file id, which was looked up before.
+func readInode(fs *TokenFS, id fuseops.InodeID) ([]byte, error) {
+	if err := fs.OpenFile(context.Background(), &fuseops.OpenFileOp{Inode: id, OpContext: testOp}); err != nil {
+		return nil, err
+	}
+
+	op := &fuseops.ReadFileOp{Inode: id, Dst: make([]byte, 64*1024), OpContext: testOp}
+	if err := fs.ReadFile(context.Background(), op); err != nil {
+		return nil, err
+	}
+
+	return op.Dst[:op.BytesRead], nil
+}
+
+// readLink returns the target of the symlink at path.
+func readLink(fs *TokenFS, path string) (string, error) {
+	id, err := lookUpPath(fs, path)
+	if err != nil {
+		return "", err
+	}
+
+	op := &fuseops.ReadSymlinkOp{Inode: id, OpContext: testOp}
+	if err := fs.ReadSymlink(context.Background(), op); err != nil {
+		return "", err
+	}
+
+	return op.Target, nil
+}
+
+// readDir lists the directory at path, reading it in chunks of size bytes like getdents does.
+func readDir(fs *TokenFS, path string, size int) ([]string, error) {
+	id, err := lookUpPath(fs, path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := fs.OpenDir(context.Background(), &fuseops.OpenDirOp{Inode: id, OpContext: testOp}); err != nil {
+		return nil, err
+	}
+
+	var names []string
+	var offset fuseops.DirOffset
+	for {
+		op := &fuseops.ReadDirOp{Inode: id, Offset: offset, Dst: make([]byte, size), OpContext: testOp}
+		if err := fs.ReadDir(context.Background(), op); err != nil {
+			return nil, err
+		}
+		if op.BytesRead == 0 {
+			return names, nil
+		}
+
+		// struct fuse_dirent: ino, off, namelen, type, then the name padded to 8 bytes
+		buf := op.Dst[:op.BytesRead]
+		for len(buf) > 0 {
+			offset = fuseops.DirOffset(binary.LittleEndian.Uint64(buf[8:]))
+			namelen := int(binary.LittleEndian.Uint32(buf[16:]))
+			names = append(names, string(buf[24:24+namelen]))
+
+			buf = buf[(24+namelen+7)&^7:]
+		}
+	}
+}
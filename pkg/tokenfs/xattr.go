@@ -0,0 +1,142 @@
+package tokenfs
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/ekristen/satokens/pkg/tokensource"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// xattrPrefix namespaces the extended attributes of the tokens.
+const xattrPrefix = "user.satokens."
+
+// xattrs returns the extended attributes of n, only tokens have any. Attributes without a value are left out.
+// They are derived from the token, so the process behind op has to be allowed to read it.
+func (fs *TokenFS) xattrs(ctx context.Context, op fuseops.OpContext, n node) (map[string]string, []string, error) {
+	f, ok := n.(fileNode)
+	if !ok || !f.secret() {
+		return nil, nil, nil
+	}
+
+	if _, err := fs.authorize(op, f); err != nil {
+		return nil, nil, err
+	}
+
+	contents, err := f.read(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	values := map[string]string{
+		"source": fs.config.Source,
+	}
+
+	if claims, err := tokensource.ParseClaims(contents); err == nil {
+		values["iss"] = claims.Issuer
+		values["sub"] = claims.Subject
+		values["aud"] = strings.Join(claims.Audience, ",")
+		values["jti"] = claims.ID
+
+		if claims.Expiry != 0 {
+			values["exp"] = strconv.FormatInt(claims.Expiry, 10)
+		}
+		if claims.IssuedAt != 0 {
+			values["iat"] = strconv.FormatInt(claims.IssuedAt, 10)
+		}
+	}
+
+	attrs := map[string]string{}
+	var names []string
+
+	// stable order for listxattr
+	for _, key := range []string{"exp", "iat", "aud", "sub", "iss", "jti", "source"} {
+		if values[key] == "" {
+			continue
+		}
+
+		attrs[xattrPrefix+key] = values[key]
+		names = append(names, xattrPrefix+key)
+	}
+
+	return attrs, names, nil
+}
+
+// fillXattr copies value into dst, following the getxattr(2) conventions: an empty dst asks for the size.
+func fillXattr(dst []byte, value []byte) (int, error) {
+	if len(dst) == 0 {
+		return len(value), nil
+	}
+
+	if len(dst) < len(value) {
+		return len(value), syscall.ERANGE
+	}
+
+	return copy(dst, value), nil
+}
+
+func (fs *TokenFS) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) error {
+	// security.selinux and the like are asked for by ls and friends, don't fetch a token for them
+	if !strings.HasPrefix(op.Name, xattrPrefix) {
+		return fuse.ENOATTR
+	}
+
+	n, err := fs.node(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	attrs, _, err := fs.xattrs(ctx, op.OpContext, n)
+	if err != nil {
+		return err
+	}
+
+	value, ok := attrs[op.Name]
+	if !ok {
+		return fuse.ENOATTR
+	}
+
+	op.BytesRead, err = fillXattr(op.Dst, []byte(value))
+	return err
+}
+
+func (fs *TokenFS) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) error {
+	n, err := fs.node(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	_, names, err := fs.xattrs(ctx, op.OpContext, n)
+	if err != nil {
+		return err
+	}
+
+	var list []byte
+	for _, name := range names {
+		list = append(list, name...)
+		list = append(list, 0)
+	}
+
+	op.BytesRead, err = fillXattr(op.Dst, list)
+	return err
+}
+
+// SetXattr and RemoveXattr fail with EROFS rather than ENOSYS, so tools report the mount as read-only.
+func (fs *TokenFS) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	return syscall.EROFS
+}
+
+func (fs *TokenFS) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	return syscall.EROFS
+}
@@ -0,0 +1,143 @@
+package tokenfs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+func TestGetXattr(t *testing.T) {
+	iat := time.Now()
+	source := &testSource{token: testToken("first", iat)}
+	fs := newTestFS(t, source, Config{Source: "server:default/satokens"})
+
+	tests := []struct {
+		name    string
+		path    string
+		attr    string
+		size    int
+		want    string
+		wantErr error
+	}{
+		{name: "subject", path: "token", attr: "user.satokens.sub", size: 1024, want: "system:serviceaccount:default:app"},
+		{name: "jti", path: "token", attr: "user.satokens.jti", size: 1024, want: "first"},
+		{name: "expiry", path: "token", attr: "user.satokens.exp", size: 1024, want: strconv.FormatInt(iat.Add(time.Hour).Unix(), 10)},
+		{name: "source", path: "token", attr: "user.satokens.source", size: 1024, want: "server:default/satokens"},
+		{name: "size", path: "token", attr: "user.satokens.jti", want: "first"},
+		{name: "too small", path: "token", attr: "user.satokens.jti", size: 2, wantErr: syscall.ERANGE},
+		{name: "unknown", path: "token", attr: "user.satokens.other", size: 1024, wantErr: fuse.ENOATTR},
+		{name: "other namespace", path: "token", attr: "security.selinux", size: 1024, wantErr: fuse.ENOATTR},
+		{name: "public file", path: "ca.crt", attr: "user.satokens.sub", size: 1024, wantErr: fuse.ENOATTR},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := lookUpPath(fs, tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			op := &fuseops.GetXattrOp{Inode: id, Name: tt.attr, Dst: make([]byte, tt.size), OpContext: testOp}
+			err = fs.GetXattr(context.Background(), op)
+			if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+				t.Fatalf("GetXattr() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			// an empty buffer asks for the size
+			if tt.size == 0 {
+				if op.BytesRead != len(tt.want) {
+					t.Errorf("GetXattr() size = %d, want %d", op.BytesRead, len(tt.want))
+				}
+				return
+			}
+
+			if got := string(op.Dst[:op.BytesRead]); got != tt.want {
+				t.Errorf("GetXattr() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListXattr(t *testing.T) {
+	fs := newTestFS(t, &testSource{token: testToken("first", time.Now())}, Config{Source: "server:default/satokens"})
+
+	id, err := lookUpPath(fs, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	op := &fuseops.ListXattrOp{Inode: id, Dst: make([]byte, 1024), OpContext: testOp}
+	if err := fs.ListXattr(context.Background(), op); err != nil {
+		t.Fatal(err)
+	}
+
+	got := strings.Split(strings.TrimSuffix(string(op.Dst[:op.BytesRead]), "\x00"), "\x00")
+	// no iss, the test token has none
+	want := []string{"exp", "iat", "aud", "sub", "jti", "source"}
+	if len(got) != len(want) {
+		t.Fatalf("ListXattr() = %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != xattrPrefix+want[i] {
+			t.Errorf("ListXattr() = %q, want %q prefixed with %s", got, want, xattrPrefix)
+		}
+	}
+}
+
+func TestXattrDoesNotFetch(t *testing.T) {
+	source := &testSource{token: testToken("first", time.Now())}
+	fs := newTestFS(t, source, Config{})
+
+	id, err := lookUpPath(fs, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// from now on any fetch fails
+	source.mu.Lock()
+	source.err = errors.New("unavailable")
+	source.mu.Unlock()
+	fs.cache.Flush()
+
+	op := &fuseops.GetXattrOp{Inode: id, Name: "security.selinux", OpContext: testOp}
+	if err := fs.GetXattr(context.Background(), op); !errors.Is(err, fuse.ENOATTR) {
+		t.Errorf("GetXattr() error = %v, want %v", err, fuse.ENOATTR)
+	}
+
+	op = &fuseops.GetXattrOp{Inode: id, Name: "user.satokens.sub", OpContext: testOp}
+	if err := fs.GetXattr(context.Background(), op); !errors.Is(err, fuse.EIO) {
+		t.Errorf("GetXattr() error = %v, want %v once the token is fetched", err, fuse.EIO)
+	}
+}
+
+func TestXattrAccess(t *testing.T) {
+	fs := newTestFS(t, &testSource{token: testToken("first", time.Now())}, Config{
+		Access: AccessPolicy{UIDs: []uint32{uint32(os.Getuid()) + 1}},
+	})
+
+	id, err := lookUpPath(fs, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := &fuseops.GetXattrOp{Inode: id, Name: "user.satokens.sub", Dst: make([]byte, 1024), OpContext: testOp}
+	if err := fs.GetXattr(context.Background(), get); !errors.Is(err, syscall.EACCES) {
+		t.Errorf("GetXattr() error = %v, want %v", err, syscall.EACCES)
+	}
+
+	list := &fuseops.ListXattrOp{Inode: id, Dst: make([]byte, 1024), OpContext: testOp}
+	if err := fs.ListXattr(context.Background(), list); !errors.Is(err, syscall.EACCES) {
+		t.Errorf("ListXattr() error = %v, want %v", err, syscall.EACCES)
+	}
+}
@@ -0,0 +1,108 @@
+package tokensource
+
+import (
+	"fmt"
+	"time"
+)
+
+// ProtocolVersion is the version of the protocol spoken between the satokens server and its clients. It is bumped
+// whenever a change can't be handled by older clients or servers, servers predating /version speak version 0.
+const ProtocolVersion = 1
+
+// Capabilities a server advertises in its Version, next to its protocol version.
+const (
+	CapabilityMetadata = "metadata" // /v1/metadata
+	CapabilityMint     = "mint"     // /v1/mint, only when the server runs with --mint
+	CapabilityWatch    = "watch"    // /v1/watch
+)
+
+// WatchKeepAlive is how often the server writes to an idle token stream, a stream that stays silent for much
+// longer than that is considered dead by the client.
+const WatchKeepAlive = 30 * time.Second
+
+// Payload is the response body returned by the satokens server.
+type Payload struct {
+	Contents  []byte `json:"contents"`
+	CACert    []byte `json:"ca.crt,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+
+	// Tokens lists the names of the additional tokens served under /tokens/<name>.
+	Tokens []string `json:"tokens,omitempty"`
+}
+
+func (p *Payload) token() *Token {
+	token := NewToken(p.Contents)
+	token.CACert = p.CACert
+	token.Namespace = p.Namespace
+	token.Additional = p.Tokens
+
+	return token
+}
+
+// Metadata is the response body of /v1/metadata, describing every token the server serves without the tokens
+// themselves.
+type Metadata struct {
+	Pod       string          `json:"pod,omitempty"`
+	Namespace string          `json:"namespace,omitempty"`
+	Tokens    []TokenMetadata `json:"tokens"`
+}
+
+// TokenMetadata describes a single token served by the server, Name is empty for the default token.
+type TokenMetadata struct {
+	Name           string     `json:"name,omitempty"`
+	ServiceAccount string     `json:"service_account,omitempty"`
+	Audience       []string   `json:"audience,omitempty"`
+	IssuedAt       *time.Time `json:"issued_at,omitempty"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+
+	// Rotations counts how often the server saw the token change since it started, LastRotation is when it
+	// last did.
+	Rotations    int        `json:"rotations"`
+	LastRotation *time.Time `json:"last_rotation,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// ErrorResponse is the body of every error response of the server.
+type ErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+// APIError is an error returned by the server.
+type APIError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("unexpected status code from server: %d", e.Code)
+	}
+
+	return fmt.Sprintf("unexpected status code from server: %d: %s", e.Code, e.Message)
+}
+
+// Version is the response body of /version.
+type Version struct {
+	Version string `json:"version"`
+	Summary string `json:"summary,omitempty"`
+	Commit  string `json:"commit,omitempty"`
+	Branch  string `json:"branch,omitempty"`
+
+	Protocol     int      `json:"protocol"`
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+// Supports returns whether the server advertised the capability, never for a nil version.
+func (v *Version) Supports(capability string) bool {
+	return v != nil && hasCapability(v.Capabilities, capability)
+}
+
+func hasCapability(capabilities []string, capability string) bool {
+	for _, c := range capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+package tokensource
+
+import (
+	"context"
+	"sort"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// ServiceAccountBrowser lists namespaces and service accounts through the Kubernetes API and mints tokens for
+// them with the TokenRequest API.
+type ServiceAccountBrowser struct {
+	Client corev1client.CoreV1Interface
+
+	// DefaultNamespace is the only namespace listed when namespaces can't be listed.
+	DefaultNamespace string
+
+	Audiences         []string
+	ExpirationSeconds int64
+}
+
+// Namespaces returns the namespaces that can be listed, falling back to the default namespace when
+// listing them is forbidden.
+func (b *ServiceAccountBrowser) Namespaces(ctx context.Context) ([]string, error) {
+	list, err := b.Client.Namespaces().List(ctx, metav1.ListOptions{})
+	if apierrors.IsForbidden(err) && b.DefaultNamespace != "" {
+		return []string{b.DefaultNamespace}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, ns := range list.Items {
+		names = append(names, ns.Name)
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// ServiceAccounts returns the service accounts in namespace.
+func (b *ServiceAccountBrowser) ServiceAccounts(ctx context.Context, namespace string) ([]string, error) {
+	list, err := b.Client.ServiceAccounts(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, sa := range list.Items {
+		names = append(names, sa.Name)
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// Source returns a source minting tokens for the service account namespace/name.
+func (b *ServiceAccountBrowser) Source(namespace, name string) TokenSource {
+	return &TokenRequestSource{
+		Client:             b.Client,
+		ConfigMaps:         b.Client,
+		Namespace:          namespace,
+		ServiceAccountName: name,
+		Audiences:          b.Audiences,
+		ExpirationSeconds:  b.ExpirationSeconds,
+	}
+}
@@ -0,0 +1,332 @@
+package tokensource
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultRefreshFraction mirrors the kubelet, which rotates projected tokens once 80% of their lifetime has passed.
+	DefaultRefreshFraction = 0.8
+
+	// DefaultRefreshInterval is used for tokens whose lifetime can't be determined from their claims.
+	DefaultRefreshInterval = time.Minute
+
+	// minRefreshInterval keeps a token that is already past its refresh point from being re-fetched in a tight loop.
+	minRefreshInterval = 10 * time.Second
+
+	fetchTimeout = 30 * time.Second
+	retryMin     = time.Second
+	retryMax     = time.Minute
+)
+
+// CacheConfig controls when a Cache refreshes and what it serves when refreshing fails.
+type CacheConfig struct {
+	// RefreshFraction is the fraction of a token's lifetime after which it is refreshed, a value outside
+	// of (0, 1] falls back to DefaultRefreshFraction.
+	RefreshFraction float64
+
+	// ServeStale keeps serving the last good token until its exp when refreshing fails, instead of
+	// failing every read until the source recovers.
+	ServeStale bool
+}
+
+// Status describes the health of a Cache.
+type Status struct {
+	LastRefresh time.Time
+	LastChange  time.Time // when a token with different contents was last cached
+	ExpiresAt   time.Time
+	LastError   error
+	LastErrorAt time.Time
+}
+
+// Cache wraps a TokenSource, serving the last token from memory and refreshing it in the background
+// before it expires. Concurrent refreshes are coalesced into a single call to the underlying source.
+type Cache struct {
+	source TokenSource
+	config CacheConfig
+
+	mu        sync.Mutex
+	token     *Token        // GUARDED_BY(mu)
+	refreshAt time.Time     // GUARDED_BY(mu)
+	inflight  *fetch        // GUARDED_BY(mu)
+	status    Status        // GUARDED_BY(mu)
+	changed   chan struct{} // GUARDED_BY(mu)
+	flushed   bool          // GUARDED_BY(mu), token is kept to detect changes but not served
+}
+
+type fetch struct {
+	done  chan struct{}
+	token *Token
+	err   error
+}
+
+func NewCache(source TokenSource, config CacheConfig) *Cache {
+	if config.RefreshFraction <= 0 || config.RefreshFraction > 1 {
+		config.RefreshFraction = DefaultRefreshFraction
+	}
+
+	return &Cache{
+		source:  source,
+		config:  config,
+		changed: make(chan struct{}),
+	}
+}
+
+// Token returns the cached token, only calling the underlying source when there is no token yet, the
+// cached one has expired, or the last refresh failed and stale tokens are not being served.
+func (c *Cache) Token(ctx context.Context) (*Token, error) {
+	c.mu.Lock()
+	token := c.token
+	failing := c.status.LastError != nil
+	flushed := c.flushed
+	c.mu.Unlock()
+
+	if token != nil && !flushed && !token.Expired(time.Now()) && (c.config.ServeStale || !failing) {
+		return token, nil
+	}
+
+	return c.Refresh(ctx)
+}
+
+// Cached returns the current token without calling the underlying source, nil if there is none yet.
+func (c *Cache) Cached() *Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.token
+}
+
+// Changed returns a channel that is closed the next time a token with different contents is cached.
+func (c *Cache) Changed() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.changed
+}
+
+// Flush drops the cached token, the next call to Token fetches a new one from the underlying source.
+func (c *Cache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.flushed = true
+}
+
+// Status returns the current health of the cache.
+func (c *Cache) Status() Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.status
+}
+
+// Refresh fetches a new token from the underlying source. If a fetch is already in progress the caller
+// waits for it and shares its result.
+func (c *Cache) Refresh(ctx context.Context) (*Token, error) {
+	c.mu.Lock()
+	f := c.inflight
+	if f == nil {
+		f = &fetch{
+			done: make(chan struct{}),
+		}
+		c.inflight = f
+
+		go c.fetch(f)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.token, f.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Run keeps the cached token fresh until ctx is done.
+func (c *Cache) Run(ctx context.Context) {
+	backoff := retryMin
+
+	for {
+		c.mu.Lock()
+		wait := time.Until(c.refreshAt)
+		changed := c.changed
+		c.mu.Unlock()
+
+		// a token pushed by Watch moves the next refresh
+		if woken, ok := sleepOrWake(ctx, wait, changed); !ok {
+			return
+		} else if woken {
+			continue
+		}
+
+		token, err := c.Refresh(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			logrus.WithError(err).Warnf("unable to refresh token, retrying in %s", backoff)
+
+			if !sleep(ctx, backoff) {
+				return
+			}
+
+			backoff *= 2
+			if backoff > retryMax {
+				backoff = retryMax
+			}
+
+			continue
+		}
+
+		backoff = retryMin
+
+		logrus.WithField("expires", token.ExpiresAt()).Debug("refreshed token")
+	}
+}
+
+// Watch keeps the cached token in sync with the tokens pushed by the underlying source, if it can push them,
+// until ctx is done. A broken stream, or a source that doesn't know yet whether it can push tokens, is tried
+// again with the same backoff as a failing refresh, Run keeps refreshing the token in the meantime.
+func (c *Cache) Watch(ctx context.Context) {
+	source, ok := c.source.(WatchingSource)
+	if !ok {
+		return
+	}
+
+	backoff := retryMin
+
+	for {
+		err := source.Watch(ctx, func(token *Token) {
+			c.mu.Lock()
+			c.store(token, time.Now())
+			c.mu.Unlock()
+
+			backoff = retryMin
+
+			logrus.WithField("expires", token.ExpiresAt()).Debug("received pushed token")
+		})
+		if ctx.Err() != nil {
+			return
+		}
+
+		if errors.Is(err, ErrWatchUnsupported) {
+			logrus.Debug("source can't push tokens, relying on refreshes")
+			return
+		}
+
+		if errors.Is(err, ErrVersionUnknown) {
+			logrus.Debugf("source doesn't know yet whether it can push tokens, checking again in %s", backoff)
+		} else {
+			logrus.WithError(err).Debugf("token stream broke, reconnecting in %s", backoff)
+		}
+
+		if !sleep(ctx, backoff) {
+			return
+		}
+
+		backoff *= 2
+		if backoff > retryMax {
+			backoff = retryMax
+		}
+	}
+}
+
+// fetch runs detached from any single caller so that one caller giving up doesn't fail everyone
+// waiting on the same fetch.
+func (c *Cache) fetch(f *fetch) {
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+	defer cancel()
+
+	f.token, f.err = c.source.Token(ctx)
+
+	now := time.Now()
+
+	c.mu.Lock()
+	if f.err == nil {
+		c.store(f.token, now)
+	} else {
+		c.status.LastError = f.err
+		c.status.LastErrorAt = now
+	}
+	c.inflight = nil
+	c.mu.Unlock()
+
+	close(f.done)
+}
+
+// store caches token as the current one, mu must be held.
+func (c *Cache) store(token *Token, now time.Time) {
+	if c.token == nil || !bytes.Equal(c.token.Contents, token.Contents) {
+		close(c.changed)
+		c.changed = make(chan struct{})
+		c.status.LastChange = now
+	}
+
+	c.token = token
+	c.flushed = false
+	c.refreshAt = c.nextRefresh(token, now)
+	c.status.LastRefresh = now
+	c.status.ExpiresAt = token.ExpiresAt()
+	c.status.LastError = nil
+}
+
+func (c *Cache) nextRefresh(token *Token, now time.Time) time.Time {
+	iat, exp := token.IssuedAt(), token.ExpiresAt()
+	if exp.IsZero() {
+		return now.Add(DefaultRefreshInterval)
+	}
+
+	if iat.IsZero() || !iat.Before(exp) {
+		iat = now
+	}
+
+	refreshAt := iat.Add(time.Duration(float64(exp.Sub(iat)) * c.config.RefreshFraction))
+	if refreshAt.Before(now.Add(minRefreshInterval)) {
+		refreshAt = now.Add(minRefreshInterval)
+	}
+
+	return refreshAt
+}
+
+// sleepOrWake is like sleep, except that it returns early with woken set when wake is closed.
+func sleepOrWake(ctx context.Context, d time.Duration, wake <-chan struct{}) (woken, ok bool) {
+	if d <= 0 {
+		return false, ctx.Err() == nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false, false
+	case <-wake:
+		return true, true
+	case <-timer.C:
+		return false, true
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
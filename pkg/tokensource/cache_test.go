@@ -0,0 +1,292 @@
+package tokensource
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// claimsToken returns a token issued and expiring at the given times, either is left out when zero.
+func claimsToken(iat, exp time.Time) *Token {
+	var payload []string
+	if !iat.IsZero() {
+		payload = append(payload, fmt.Sprintf(`"iat":%d`, iat.Unix()))
+	}
+	if !exp.IsZero() {
+		payload = append(payload, fmt.Sprintf(`"exp":%d`, exp.Unix()))
+	}
+
+	return NewToken(testJWT("{" + strings.Join(payload, ",") + "}"))
+}
+
+func TestCacheNextRefresh(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name     string
+		fraction float64
+		iat      time.Time
+		exp      time.Time
+		want     time.Time
+	}{
+		{
+			name: "fresh token",
+			iat:  now,
+			exp:  now.Add(time.Hour),
+			want: now.Add(48 * time.Minute),
+		},
+		{
+			name: "token issued earlier",
+			iat:  now.Add(-time.Hour),
+			exp:  now.Add(time.Hour),
+			want: now.Add(36 * time.Minute),
+		},
+		{
+			name:     "custom fraction",
+			fraction: 0.5,
+			iat:      now,
+			exp:      now.Add(time.Hour),
+			want:     now.Add(30 * time.Minute),
+		},
+		{
+			name: "past the refresh point",
+			iat:  now.Add(-time.Hour),
+			exp:  now.Add(5 * time.Minute),
+			want: now.Add(minRefreshInterval),
+		},
+		{
+			name: "expired",
+			iat:  now.Add(-2 * time.Hour),
+			exp:  now.Add(-time.Hour),
+			want: now.Add(minRefreshInterval),
+		},
+		{
+			name: "no iat",
+			exp:  now.Add(time.Hour),
+			want: now.Add(48 * time.Minute),
+		},
+		{
+			name: "iat after exp",
+			iat:  now.Add(2 * time.Hour),
+			exp:  now.Add(time.Hour),
+			want: now.Add(48 * time.Minute),
+		},
+		{
+			name: "no exp",
+			iat:  now,
+			want: now.Add(DefaultRefreshInterval),
+		},
+		{
+			name:     "fraction out of range",
+			fraction: 1.5,
+			iat:      now,
+			exp:      now.Add(time.Hour),
+			want:     now.Add(48 * time.Minute),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCache(nil, CacheConfig{RefreshFraction: tt.fraction})
+
+			if got := c.nextRefresh(claimsToken(tt.iat, tt.exp), now); !got.Equal(tt.want) {
+				t.Errorf("nextRefresh() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// blockingSource counts its calls and blocks them until release is closed.
+type blockingSource struct {
+	release chan struct{}
+	token   *Token
+	err     error
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (s *blockingSource) Token(ctx context.Context) (*Token, error) {
+	s.mu.Lock()
+	s.calls++
+	s.mu.Unlock()
+
+	<-s.release
+
+	return s.token, s.err
+}
+
+func (s *blockingSource) Calls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.calls
+}
+
+func TestCacheRefreshCoalesces(t *testing.T) {
+	token := claimsToken(time.Now(), time.Now().Add(time.Hour))
+
+	tests := []struct {
+		name      string
+		token     *Token
+		err       error
+		callers   int
+		wantError bool
+	}{
+		{name: "single caller", token: token, callers: 1},
+		{name: "concurrent callers", token: token, callers: 10},
+		{name: "concurrent callers failing", err: errors.New("unavailable"), callers: 10, wantError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := &blockingSource{
+				release: make(chan struct{}),
+				token:   tt.token,
+				err:     tt.err,
+			}
+			c := NewCache(source, CacheConfig{})
+
+			// callers that give up join the fetch in flight without failing it for the others
+			cancelled, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			for i := 0; i < tt.callers; i++ {
+				if _, err := c.Refresh(cancelled); !errors.Is(err, context.Canceled) {
+					t.Fatalf("Refresh() with cancelled context error = %v, want %v", err, context.Canceled)
+				}
+			}
+
+			changed := c.Changed()
+			close(source.release)
+
+			if tt.wantError {
+				waitFor(t, func() bool { return c.Status().LastError != nil })
+			} else {
+				select {
+				case <-changed:
+				case <-time.After(5 * time.Second):
+					t.Fatal("token wasn't cached")
+				}
+
+				if got := c.Cached(); got != tt.token {
+					t.Errorf("Cached() = %v, want %v", got, tt.token)
+				}
+			}
+
+			if calls := source.Calls(); calls != 1 {
+				t.Errorf("source called %d times, want 1", calls)
+			}
+
+			// the next refresh fetches again
+			if _, err := c.Refresh(context.Background()); (err != nil) != tt.wantError {
+				t.Errorf("Refresh() error = %v, wantError %v", err, tt.wantError)
+			}
+			if calls := source.Calls(); calls != 2 {
+				t.Errorf("source called %d times, want 2", calls)
+			}
+		})
+	}
+}
+
+// watchingSource fails its first watches with errs, later ones push token and hold the stream open.
+type watchingSource struct {
+	token *Token
+	errs  []error
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (s *watchingSource) Token(ctx context.Context) (*Token, error) {
+	return s.token, nil
+}
+
+func (s *watchingSource) Watch(ctx context.Context, fn func(*Token)) error {
+	s.mu.Lock()
+	call := s.calls
+	s.calls++
+	s.mu.Unlock()
+
+	if call < len(s.errs) {
+		return s.errs[call]
+	}
+
+	fn(s.token)
+	<-ctx.Done()
+
+	return ctx.Err()
+}
+
+func (s *watchingSource) Calls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.calls
+}
+
+func TestCacheWatch(t *testing.T) {
+	token := claimsToken(time.Now(), time.Now().Add(time.Hour))
+
+	tests := []struct {
+		name       string
+		errs       []error
+		wantPushed bool
+		wantCalls  int
+	}{
+		{name: "pushed", wantPushed: true, wantCalls: 1},
+		{name: "version unknown", errs: []error{ErrVersionUnknown}, wantPushed: true, wantCalls: 2},
+		{name: "stream broke", errs: []error{errors.New("connection reset")}, wantPushed: true, wantCalls: 2},
+		{name: "unsupported", errs: []error{ErrWatchUnsupported}, wantCalls: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := &watchingSource{token: token, errs: tt.errs}
+			c := NewCache(source, CacheConfig{})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				c.Watch(ctx)
+			}()
+
+			if tt.wantPushed {
+				waitFor(t, func() bool { return c.Cached() == token })
+				cancel()
+			}
+
+			// Watch gives up on a source that can't push tokens by itself
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Watch() didn't return")
+			}
+			cancel()
+
+			if calls := source.Calls(); calls != tt.wantCalls {
+				t.Errorf("source watched %d times, want %d", calls, tt.wantCalls)
+			}
+			if !tt.wantPushed && c.Cached() != nil {
+				t.Error("token cached without a push")
+			}
+		})
+	}
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,105 @@
+package tokensource
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Claims are the registered JWT claims of a service account token.
+type Claims struct {
+	Issuer    string   `json:"iss,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Audience  Audience `json:"aud,omitempty"`
+	Expiry    int64    `json:"exp,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	ID        string   `json:"jti,omitempty"`
+}
+
+// Audience is the aud claim, which per RFC 7519 may be either a single string or an array of strings.
+type Audience []string
+
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		var auds []string
+		if err := json.Unmarshal(data, &auds); err != nil {
+			return err
+		}
+		*a = auds
+		return nil
+	}
+
+	var aud string
+	if err := json.Unmarshal(data, &aud); err != nil {
+		return err
+	}
+	*a = Audience{aud}
+
+	return nil
+}
+
+// ExpiresAt returns the exp claim as a time, the zero time if it is not set.
+func (c *Claims) ExpiresAt() time.Time {
+	if c == nil || c.Expiry == 0 {
+		return time.Time{}
+	}
+	return time.Unix(c.Expiry, 0)
+}
+
+// IssuedAtTime returns the iat claim as a time, the zero time if it is not set.
+func (c *Claims) IssuedAtTime() time.Time {
+	if c == nil || c.IssuedAt == 0 {
+		return time.Time{}
+	}
+	return time.Unix(c.IssuedAt, 0)
+}
+
+// serviceAccountPrefix starts the sub claim of service account tokens, system:serviceaccount:<namespace>:<name>.
+const serviceAccountPrefix = "system:serviceaccount:"
+
+// ServiceAccount returns the namespace and name of the service account from the sub claim, ok is false if
+// the token wasn't issued for a service account.
+func (c *Claims) ServiceAccount() (namespace, name string, ok bool) {
+	if c == nil || !strings.HasPrefix(c.Subject, serviceAccountPrefix) {
+		return "", "", false
+	}
+
+	namespace, name, ok = strings.Cut(strings.TrimPrefix(c.Subject, serviceAccountPrefix), ":")
+	return namespace, name, ok
+}
+
+// DecodePayload decodes the JSON payload of a JWT, with all of its claims. The signature is NOT verified.
+func DecodePayload(contents []byte) ([]byte, error) {
+	parts := bytes.Split(bytes.TrimSpace(contents), []byte("."))
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("token is not a jwt: expected 3 parts, got %d", len(parts))
+	}
+
+	payload := make([]byte, base64.RawURLEncoding.DecodedLen(len(parts[1])))
+	n, err := base64.RawURLEncoding.Decode(payload, bytes.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode jwt payload: %w", err)
+	}
+
+	return payload[:n], nil
+}
+
+// ParseClaims decodes the payload of a JWT. The signature is NOT verified, the claims are only used to
+// make caching decisions and to describe the token.
+func ParseClaims(contents []byte) (*Claims, error) {
+	payload, err := DecodePayload(contents)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("unable to parse jwt claims: %w", err)
+	}
+
+	return &claims, nil
+}
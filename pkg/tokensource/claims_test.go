@@ -0,0 +1,143 @@
+package tokensource
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// testJWT returns a JWT with the given payload and a bogus signature, which is never verified.
+func testJWT(payload string) []byte {
+	return []byte("e30." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".sig")
+}
+
+func TestParseClaims(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents []byte
+		want     *Claims
+		wantErr  bool
+	}{
+		{
+			name:     "service account token",
+			contents: testJWT(`{"iss":"https://kubernetes.default.svc","sub":"system:serviceaccount:default:app","aud":["sts.amazonaws.com"],"exp":1700003600,"iat":1700000000,"nbf":1700000000,"jti":"abc"}`),
+			want: &Claims{
+				Issuer:    "https://kubernetes.default.svc",
+				Subject:   "system:serviceaccount:default:app",
+				Audience:  Audience{"sts.amazonaws.com"},
+				Expiry:    1700003600,
+				IssuedAt:  1700000000,
+				NotBefore: 1700000000,
+				ID:        "abc",
+			},
+		},
+		{
+			name:     "single audience",
+			contents: testJWT(`{"aud":"vault"}`),
+			want:     &Claims{Audience: Audience{"vault"}},
+		},
+		{
+			name:     "surrounding whitespace",
+			contents: append(append([]byte("\n"), testJWT(`{"exp":1}`)...), '\n'),
+			want:     &Claims{Expiry: 1},
+		},
+		{
+			name:     "padded payload",
+			contents: []byte("e30." + base64.URLEncoding.EncodeToString([]byte(`{"exp":1}`)) + ".sig"),
+			want:     &Claims{Expiry: 1},
+		},
+		{
+			name:     "not a jwt",
+			contents: []byte("token"),
+			wantErr:  true,
+		},
+		{
+			name:     "invalid base64",
+			contents: []byte("e30.!!!.sig"),
+			wantErr:  true,
+		},
+		{
+			name:     "invalid json",
+			contents: testJWT(`{"exp":`),
+			wantErr:  true,
+		},
+		{
+			name:     "invalid audience",
+			contents: testJWT(`{"aud":1}`),
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseClaims(tt.contents)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseClaims() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseClaims() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAudience(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		want    Audience
+		wantErr bool
+	}{
+		{name: "string", json: `"sts.amazonaws.com"`, want: Audience{"sts.amazonaws.com"}},
+		{name: "array", json: `["a","b"]`, want: Audience{"a", "b"}},
+		{name: "array with whitespace", json: ` [ "a" ]`, want: Audience{"a"}},
+		{name: "empty array", json: `[]`, want: Audience{}},
+		{name: "empty string", json: `""`, want: Audience{""}},
+		{name: "number", json: `1`, wantErr: true},
+		{name: "array of numbers", json: `[1]`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Audience
+			err := json.Unmarshal([]byte(tt.json), &got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Unmarshal() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Unmarshal() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClaimsServiceAccount(t *testing.T) {
+	tests := []struct {
+		name          string
+		claims        *Claims
+		wantNamespace string
+		wantName      string
+		wantOK        bool
+	}{
+		{
+			name:          "service account",
+			claims:        &Claims{Subject: "system:serviceaccount:kube-system:default"},
+			wantNamespace: "kube-system",
+			wantName:      "default",
+			wantOK:        true,
+		},
+		{name: "user", claims: &Claims{Subject: "jane"}},
+		{name: "missing name", claims: &Claims{Subject: "system:serviceaccount:default"}},
+		{name: "nil", claims: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			namespace, name, ok := tt.claims.ServiceAccount()
+			if ok != tt.wantOK || (ok && (namespace != tt.wantNamespace || name != tt.wantName)) {
+				t.Errorf("ServiceAccount() = %q, %q, %v, want %q, %q, %v", namespace, name, ok, tt.wantNamespace, tt.wantName, tt.wantOK)
+			}
+		})
+	}
+}
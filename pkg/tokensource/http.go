@@ -0,0 +1,337 @@
+package tokensource
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrMintUnsupported is returned for minted tokens until the server has been checked to mint them.
+var ErrMintUnsupported = errors.New("the server isn't known to mint tokens")
+
+// MintRequest asks the server to mint a token with the TokenRequest API, rather than serve a projected one.
+type MintRequest struct {
+	// ServiceAccount in the namespace of the server, the service account of the server pod when empty.
+	ServiceAccount    string
+	Audience          string
+	ExpirationSeconds int64
+}
+
+// Query encodes the request as the query of the /mint endpoint.
+func (r *MintRequest) Query() neturl.Values {
+	query := neturl.Values{}
+
+	if r.ServiceAccount != "" {
+		query.Set("service_account", r.ServiceAccount)
+	}
+	if r.Audience != "" {
+		query.Set("audience", r.Audience)
+	}
+	if r.ExpirationSeconds > 0 {
+		query.Set("expiration", strconv.FormatInt(r.ExpirationSeconds, 10))
+	}
+
+	return query
+}
+
+// HTTPSource retrieves the token from a satokens server, typically through a port-forward.
+type HTTPSource struct {
+	URL    string
+	Client *http.Client
+
+	// Name selects one of the additional tokens of the server, the default token when empty.
+	Name string
+
+	// Server is what was learned about the server from Version, it is shared with the sources derived from this
+	// one. Until it is known the server is assumed to predate versioning and only serve / and /tokens/<name>.
+	Server *ServerInfo
+
+	// Minting, when set, has the server mint the token instead, which requires it to run with --mint.
+	Minting *MintRequest
+
+	// Ready, when set, is checked before every request so that a known dead connection fails fast
+	// instead of waiting on a timeout.
+	Ready func(ctx context.Context) error
+}
+
+// ServerInfo holds the version of a server, it is safe for concurrent use.
+type ServerInfo struct {
+	mu      sync.RWMutex
+	version *Version
+}
+
+// Set records the version of the server, learned again whenever the connection to it is re-established.
+func (i *ServerInfo) Set(version *Version) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.version = version
+}
+
+// Version returns the last version recorded, nil when the server hasn't been checked yet.
+func (i *ServerInfo) Version() *Version {
+	if i == nil {
+		return nil
+	}
+
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return i.version
+}
+
+func NewHTTPSource(url string) *HTTPSource {
+	return &HTTPSource{
+		URL: url,
+		Client: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+		Server: &ServerInfo{},
+	}
+}
+
+func (s *HTTPSource) Token(ctx context.Context) (*Token, error) {
+	if s.Ready != nil {
+		if err := s.Ready(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.Minting != nil && !s.Server.Version().Supports(CapabilityMint) {
+		return nil, ErrMintUnsupported
+	}
+
+	var url string
+	switch {
+	case s.Minting != nil:
+		url = fmt.Sprintf("%s/mint?%s", s.base(), s.Minting.Query().Encode())
+	case s.Name != "":
+		url = fmt.Sprintf("%s/tokens/%s", s.base(), neturl.PathEscape(s.Name))
+	case s.protocol() >= 1:
+		url = fmt.Sprintf("%s/token", s.base())
+	default:
+		url = s.URL
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+
+	var data Payload
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+
+	return data.token(), nil
+}
+
+// Watch streams the token from the server, which pushes it as soon as kubelet rotates it. Only servers that
+// advertise CapabilityWatch can, for others and for minted tokens ErrWatchUnsupported is returned. Until the
+// version of the server is known ErrVersionUnknown is returned instead.
+func (s *HTTPSource) Watch(ctx context.Context, fn func(*Token)) error {
+	if s.Minting != nil {
+		return ErrWatchUnsupported
+	}
+
+	version := s.Server.Version()
+	if version == nil {
+		return ErrVersionUnknown
+	}
+	if !version.Supports(CapabilityWatch) {
+		return ErrWatchUnsupported
+	}
+
+	if s.Ready != nil {
+		if err := s.Ready(ctx); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// the server writes at least every WatchKeepAlive, a stream that stays silent is on a dead connection
+	idle := time.AfterFunc(2*WatchKeepAlive, cancel)
+	defer idle.Stop()
+
+	query := neturl.Values{}
+	if s.Name != "" {
+		query.Set("name", s.Name)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/watch?%s", s.base(), query.Encode()), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	// the timeout of the client covers reading the body, which never ends for a stream
+	client := *s.Client
+	client.Timeout = 0
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+
+	var event string
+	var data []byte
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		idle.Reset(2 * WatchKeepAlive)
+
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if event == "token" {
+				var payload Payload
+				if err := json.Unmarshal(data, &payload); err != nil {
+					return fmt.Errorf("unable to decode pushed token: %w", err)
+				}
+				fn(payload.token())
+			}
+			event, data = "", nil
+		case strings.HasPrefix(line, ":"):
+			// comment, used as keep-alive
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " ")...)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return io.ErrUnexpectedEOF
+}
+
+// Version asks the server for its version and the protocol it speaks. Servers predating /version are reported
+// as protocol version 0.
+func (s *HTTPSource) Version(ctx context.Context) (*Version, error) {
+	if s.Ready != nil {
+		if err := s.Ready(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/version", strings.TrimSuffix(s.URL, "/")), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return &Version{}, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+
+	var version Version
+	if err := json.NewDecoder(resp.Body).Decode(&version); err != nil {
+		return nil, err
+	}
+
+	return &version, nil
+}
+
+// base returns the URL the routes of the protocol spoken by the server are relative to.
+func (s *HTTPSource) base() string {
+	base := strings.TrimSuffix(s.URL, "/")
+	if s.protocol() >= 1 {
+		base += "/v1"
+	}
+	return base
+}
+
+// protocol returns the version of the protocol to speak with the server, the newest both understand.
+func (s *HTTPSource) protocol() int {
+	version := s.Server.Version()
+	if version == nil {
+		return 0
+	}
+	if version.Protocol > ProtocolVersion {
+		return ProtocolVersion
+	}
+	return version.Protocol
+}
+
+// Named returns a source for one of the additional tokens served by the same server.
+func (s *HTTPSource) Named(name string) TokenSource {
+	named := *s
+	named.Name = name
+	named.Minting = nil
+	return &named
+}
+
+// MintFor returns a source for tokens the server mints for the service account name with the TokenRequest API.
+func (s *HTTPSource) MintFor(name, audience string, expirationSeconds int64) *HTTPSource {
+	minted := *s
+	minted.Name = ""
+	minted.Minting = &MintRequest{
+		ServiceAccount:    name,
+		Audience:          audience,
+		ExpirationSeconds: expirationSeconds,
+	}
+	return &minted
+}
+
+// Mint returns a source for tokens the server mints for the same service account, that of the pod unless this
+// source already mints them for another one.
+func (s *HTTPSource) Mint(audience string, expirationSeconds int64) TokenSource {
+	var name string
+	if s.Minting != nil {
+		name = s.Minting.ServiceAccount
+	}
+
+	return s.MintFor(name, audience, expirationSeconds)
+}
+
+// responseError returns the error described by the body of a failed response, servers predating structured
+// errors send an empty body.
+func responseError(resp *http.Response) error {
+	var body ErrorResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&body); err != nil || body.Error.Code == 0 {
+		return &APIError{Code: resp.StatusCode}
+	}
+
+	return &body.Error
+}
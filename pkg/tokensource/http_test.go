@@ -0,0 +1,308 @@
+package tokensource
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestHTTPSourceVersion(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		body       string
+		want       *Version
+		wantAPIErr int
+	}{
+		{
+			name: "versioned",
+			body: `{"version":"v1.2.0","protocol":1,"capabilities":["metadata","watch"]}`,
+			want: &Version{Version: "v1.2.0", Protocol: 1, Capabilities: []string{CapabilityMetadata, CapabilityWatch}},
+		},
+		{
+			name:   "predates versioning",
+			status: http.StatusNotFound,
+			want:   &Version{},
+		},
+		{
+			name:       "error",
+			status:     http.StatusInternalServerError,
+			wantAPIErr: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/version" {
+					t.Errorf("request for %s, want /version", r.URL.Path)
+				}
+
+				if tt.status != 0 {
+					w.WriteHeader(tt.status)
+				}
+				_, _ = io.WriteString(w, tt.body)
+			}))
+			defer server.Close()
+
+			got, err := NewHTTPSource(server.URL).Version(context.Background())
+			if tt.wantAPIErr != 0 {
+				var apiErr *APIError
+				if !errors.As(err, &apiErr) || apiErr.Code != tt.wantAPIErr {
+					t.Errorf("Version() error = %v, want an APIError with code %d", err, tt.wantAPIErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got.Version != tt.want.Version || got.Protocol != tt.want.Protocol || !reflect.DeepEqual(got.Capabilities, tt.want.Capabilities) {
+				t.Errorf("Version() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHTTPSourceRoutes(t *testing.T) {
+	v0 := &Version{}
+	v1 := &Version{Protocol: 1}
+	newer := &Version{Protocol: ProtocolVersion + 1, Capabilities: []string{CapabilityMint}}
+	minting := &Version{Protocol: 1, Capabilities: []string{CapabilityMint}}
+
+	tests := []struct {
+		name    string
+		version *Version
+		source  func(s *HTTPSource) TokenSource
+		want    string
+		wantErr error
+	}{
+		{name: "not checked", want: "/"},
+		{name: "protocol 0", version: v0, want: "/"},
+		{name: "protocol 1", version: v1, want: "/v1/token"},
+		{name: "newer protocol", version: newer, want: "/v1/token"},
+		{
+			name:    "named before versioning",
+			version: v0,
+			source:  func(s *HTTPSource) TokenSource { return s.Named("vault") },
+			want:    "/tokens/vault",
+		},
+		{
+			name:    "named",
+			version: v1,
+			source:  func(s *HTTPSource) TokenSource { return s.Named("vault") },
+			want:    "/v1/tokens/vault",
+		},
+		{
+			name:    "minted",
+			version: minting,
+			source:  func(s *HTTPSource) TokenSource { return s.Mint("vault", 600) },
+			want:    "/v1/mint?audience=vault&expiration=600",
+		},
+		{
+			name:    "minted for another service account",
+			version: minting,
+			source:  func(s *HTTPSource) TokenSource { return s.MintFor("worker", "", 0) },
+			want:    "/v1/mint?service_account=worker",
+		},
+		{
+			name:    "server doesn't mint",
+			version: v1,
+			source:  func(s *HTTPSource) TokenSource { return s.Mint("vault", 600) },
+			wantErr: ErrMintUnsupported,
+		},
+		{
+			name:    "minting not checked",
+			source:  func(s *HTTPSource) TokenSource { return s.Mint("vault", 600) },
+			wantErr: ErrMintUnsupported,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.URL.RequestURI()
+				_, _ = io.WriteString(w, `{"contents":"Zmlyc3Q="}`)
+			}))
+			defer server.Close()
+
+			base := NewHTTPSource(server.URL)
+			base.Server.Set(tt.version)
+
+			var source TokenSource = base
+			if tt.source != nil {
+				source = tt.source(base)
+			}
+
+			token, err := source.Token(context.Background())
+			if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+				t.Fatalf("Token() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if got != "" {
+					t.Errorf("request for %s, want none", got)
+				}
+				return
+			}
+
+			if got != tt.want {
+				t.Errorf("request for %s, want %s", got, tt.want)
+			}
+			if string(token.Contents) != "first" {
+				t.Errorf("Token() = %q, want %q", token.Contents, "first")
+			}
+		})
+	}
+}
+
+func TestHTTPSourceWatch(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		body       string
+		want       []string
+		wantErr    error
+		wantAPIErr int
+	}{
+		{
+			name: "tokens",
+			body: "event: token\ndata: {\"contents\":\"Zmlyc3Q=\"}\n\n" +
+				"event: token\ndata: {\"contents\":\"c2Vjb25k\"}\n\n",
+			want:    []string{"first", "second"},
+			wantErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name:    "keep-alive comments",
+			body:    ": keep-alive\n\nevent: token\n: in between\ndata: {\"contents\":\"Zmlyc3Q=\"}\n\n: keep-alive\n\n",
+			want:    []string{"first"},
+			wantErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name:    "data without a space",
+			body:    "event:token\ndata:{\"contents\":\"Zmlyc3Q=\"}\n\n",
+			want:    []string{"first"},
+			wantErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name:    "data split over lines",
+			body:    "event: token\ndata: {\"contents\":\ndata: \"Zmlyc3Q=\"}\n\n",
+			want:    []string{"first"},
+			wantErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name:    "other events",
+			body:    "event: other\ndata: {}\n\ndata: {\"contents\":\"Zmlyc3Q=\"}\n\nevent: token\ndata: {\"contents\":\"c2Vjb25k\"}\n\n",
+			want:    []string{"second"},
+			wantErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name:    "event without a blank line",
+			body:    "event: token\ndata: {\"contents\":\"Zmlyc3Q=\"}\n",
+			wantErr: io.ErrUnexpectedEOF,
+		},
+		{
+			name: "invalid data",
+			body: "event: token\ndata: {\n\n",
+		},
+		{
+			name:       "error response",
+			status:     http.StatusNotFound,
+			body:       `{"error":{"code":404,"message":"unknown token"}}`,
+			wantAPIErr: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/v1/watch" {
+					t.Errorf("request for %s, want /v1/watch", r.URL.Path)
+				}
+
+				if tt.status != 0 {
+					w.WriteHeader(tt.status)
+				}
+				_, _ = io.WriteString(w, tt.body)
+			}))
+			defer server.Close()
+
+			source := NewHTTPSource(server.URL)
+			source.Server.Set(&Version{Protocol: ProtocolVersion, Capabilities: []string{CapabilityWatch}})
+
+			var got []string
+			err := source.Watch(context.Background(), func(token *Token) {
+				got = append(got, string(token.Contents))
+			})
+
+			switch {
+			case tt.wantAPIErr != 0:
+				var apiErr *APIError
+				if !errors.As(err, &apiErr) || apiErr.Code != tt.wantAPIErr {
+					t.Errorf("Watch() error = %v, want an APIError with code %d", err, tt.wantAPIErr)
+				}
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("Watch() error = %v, want %v", err, tt.wantErr)
+				}
+			case err == nil:
+				t.Error("Watch() error = nil, want an error")
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Watch() pushed %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHTTPSourceWatchUnsupported(t *testing.T) {
+	tests := []struct {
+		name    string
+		version *Version
+		mint    bool
+		wantErr error
+	}{
+		{name: "not checked", wantErr: ErrVersionUnknown},
+		{name: "protocol 0", version: &Version{}, wantErr: ErrWatchUnsupported},
+		{name: "without watch", version: &Version{Protocol: ProtocolVersion, Capabilities: []string{CapabilityMetadata}}, wantErr: ErrWatchUnsupported},
+		{name: "minted", version: &Version{Protocol: ProtocolVersion, Capabilities: []string{CapabilityWatch, CapabilityMint}}, mint: true, wantErr: ErrWatchUnsupported},
+		{name: "minted not checked", mint: true, wantErr: ErrWatchUnsupported},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := NewHTTPSource("http://127.0.0.1:0")
+			source.Server.Set(tt.version)
+			if tt.mint {
+				source = source.MintFor("app", "vault", 0)
+			}
+
+			err := source.Watch(context.Background(), func(*Token) {
+				t.Error("token pushed")
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Watch() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestServerInfoShared(t *testing.T) {
+	source := NewHTTPSource("http://127.0.0.1:0")
+	named := source.Named("vault").(*HTTPSource)
+	minted := source.Mint("vault", 600).(*HTTPSource)
+
+	// learned again after reconnecting, derived sources follow
+	source.Server.Set(&Version{Protocol: 1})
+
+	for _, s := range []*HTTPSource{named, minted} {
+		if s.protocol() != 1 {
+			t.Errorf("protocol of a derived source = %d, want 1", s.protocol())
+		}
+	}
+}
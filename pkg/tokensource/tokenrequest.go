@@ -0,0 +1,64 @@
+package tokensource
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// RootCAConfigMap is published into every namespace by kube-controller-manager and is what kubelet projects
+// as ca.crt into pods.
+const RootCAConfigMap = "kube-root-ca.crt"
+
+// TokenRequestSource mints tokens directly from the Kubernetes TokenRequest API, no pod required.
+type TokenRequestSource struct {
+	Client             corev1client.ServiceAccountsGetter
+	ConfigMaps         corev1client.ConfigMapsGetter // optional, used to look up ca.crt
+	Namespace          string
+	ServiceAccountName string
+	Audiences          []string
+	ExpirationSeconds  int64
+}
+
+func (s *TokenRequestSource) Token(ctx context.Context) (*Token, error) {
+	tr := &authenticationv1.TokenRequest{
+		Spec: authenticationv1.TokenRequestSpec{
+			Audiences: s.Audiences,
+		},
+	}
+
+	if s.ExpirationSeconds > 0 {
+		tr.Spec.ExpirationSeconds = &[]int64{s.ExpirationSeconds}[0]
+	}
+
+	res, err := s.Client.ServiceAccounts(s.Namespace).CreateToken(ctx, s.ServiceAccountName, tr, metav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to create token for %s/%s: %w", s.Namespace, s.ServiceAccountName, err)
+	}
+
+	token := NewToken([]byte(res.Status.Token))
+	token.Namespace = s.Namespace
+
+	if s.ConfigMaps != nil {
+		cm, err := s.ConfigMaps.ConfigMaps(s.Namespace).Get(ctx, RootCAConfigMap, metav1.GetOptions{})
+		if err != nil {
+			logrus.WithError(err).Warnf("unable to get %s, ca.crt will not be available", RootCAConfigMap)
+		} else {
+			token.CACert = []byte(cm.Data["ca.crt"])
+		}
+	}
+
+	return token, nil
+}
+
+// Mint returns a source for tokens of the same service account with a different audience and expiration.
+func (s *TokenRequestSource) Mint(audience string, expirationSeconds int64) TokenSource {
+	minted := *s
+	minted.Audiences = []string{audience}
+	minted.ExpirationSeconds = expirationSeconds
+
+	return &minted
+}
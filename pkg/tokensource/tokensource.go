@@ -0,0 +1,90 @@
+package tokensource
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// TokenSource is anything that can provide the service account token served by the token filesystem.
+type TokenSource interface {
+	Token(ctx context.Context) (*Token, error)
+}
+
+// NamedSource is implemented by sources that can provide the additional tokens listed in Token.Additional.
+type NamedSource interface {
+	TokenSource
+	Named(name string) TokenSource
+}
+
+// MinExpirationSeconds is the shortest expiration the TokenRequest API accepts.
+const MinExpirationSeconds = 600
+
+// MintingSource is implemented by sources that can issue tokens for any audience and expiration.
+type MintingSource interface {
+	TokenSource
+	Mint(audience string, expirationSeconds int64) TokenSource
+}
+
+// ErrWatchUnsupported is returned by Watch when the source can't push tokens after all, e.g. because the server
+// it talks to predates streaming.
+var ErrWatchUnsupported = errors.New("source can't push tokens")
+
+// ErrVersionUnknown is returned by Watch while it isn't known yet whether the source can push tokens, e.g. because
+// the server it talks to hasn't been reached yet. Unlike ErrWatchUnsupported it is worth trying again.
+var ErrVersionUnknown = errors.New("source hasn't been checked to push tokens yet")
+
+// WatchingSource is implemented by sources that can push new tokens as soon as they are issued.
+type WatchingSource interface {
+	TokenSource
+
+	// Watch calls fn with the current token and every one after it until ctx is done or the stream breaks,
+	// which is reported as an error.
+	Watch(ctx context.Context, fn func(*Token)) error
+}
+
+// Token is a service account token as returned by a TokenSource.
+type Token struct {
+	Contents []byte
+
+	// CACert and Namespace complete the in-cluster serviceaccount directory, they are empty when the
+	// source can't provide them.
+	CACert    []byte
+	Namespace string
+
+	// Additional are the names of other tokens, for different audiences or expirations, that the source
+	// can provide through NamedSource.
+	Additional []string
+
+	// Claims are parsed from Contents by NewToken, nil if the token could not be decoded.
+	Claims *Claims
+}
+
+// NewToken wraps the raw token contents and decodes its claims when possible.
+func NewToken(contents []byte) *Token {
+	token := &Token{
+		Contents: contents,
+	}
+
+	if claims, err := ParseClaims(contents); err == nil {
+		token.Claims = claims
+	}
+
+	return token
+}
+
+// ExpiresAt returns when the token expires, the zero time if unknown.
+func (t *Token) ExpiresAt() time.Time {
+	return t.Claims.ExpiresAt()
+}
+
+// IssuedAt returns when the token was issued, the zero time if unknown.
+func (t *Token) IssuedAt() time.Time {
+	return t.Claims.IssuedAtTime()
+}
+
+// Expired reports whether the token is past its exp claim. Tokens without an exp never expire.
+func (t *Token) Expired(now time.Time) bool {
+	exp := t.ExpiresAt()
+	return !exp.IsZero() && !now.Before(exp)
+}